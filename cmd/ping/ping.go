@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"time"
 
@@ -13,7 +15,7 @@ import (
 var usage = `
 Usage:
 
-    ping [-c count] [-i interval] [-t timeout] [--privileged] host
+    ping [-c count] [-i interval] [-t timeout] [-s size] [-p pattern] [-I source] [-Q tos] [-f] [-q] [--privileged] host
 
 Examples:
 
@@ -29,6 +31,25 @@ Examples:
     # ping google for 10 seconds
     ping -t 10s www.google.com
 
+    # ping google with 1000 bytes of data in each packet
+    ping -s 1000 www.google.com
+
+    # ping google with each packet's data filled with 0xff00
+    ping -p ff00 www.google.com
+
+    # ping google from a specific address or interface
+    ping -I 192.168.1.2 www.google.com
+    ping -I eth0 www.google.com
+
+    # ping google with DSCP EF set
+    ping -Q 184 www.google.com
+
+    # ping google 1000 times, as fast as it replies
+    ping -f -c 1000 www.google.com
+
+    # ping google 5 times, only printing the summary
+    ping -q -c 5 www.google.com
+
     # Send a privileged raw ICMP ping
     sudo ping --privileged www.google.com
 `
@@ -37,6 +58,12 @@ func main() {
 	timeout := flag.Duration("t", time.Second*100000, "")
 	interval := flag.Duration("i", time.Second, "")
 	count := flag.Int("c", -1, "")
+	size := flag.Int("s", 8, "")
+	pattern := flag.String("p", "", "")
+	source := flag.String("I", "", "")
+	tos := flag.Int("Q", 0, "")
+	flood := flag.Bool("f", false, "")
+	quiet := flag.Bool("q", false, "")
 	privileged := flag.Bool("privileged", false, "")
 	flag.Usage = func() {
 		fmt.Print(usage)
@@ -57,9 +84,19 @@ func main() {
 		return
 	}
 
-	pinger.OnRecv = func(pkt *ping.Packet) {
-		fmt.Printf("%d bytes from %s: icmp_seq=%d time=%v\n",
-			pkt.Nbytes, pkt.IPAddr, pkt.Seq, pkt.Rtt)
+	// In quiet mode, only the summary is printed
+	if !*quiet {
+		pinger.OnRecv = func(pkt *ping.Packet) {
+			fmt.Printf("%d bytes from %s: icmp_seq=%d ttl=%d time=%v\n",
+				pkt.Nbytes, pkt.Src, pkt.Seq, pkt.TTL, pkt.Rtt)
+		}
+		pinger.OnDuplicateRecv = func(pkt *ping.Packet) {
+			fmt.Printf("%d bytes from %s: icmp_seq=%d ttl=%d time=%v (DUP!)\n",
+				pkt.Nbytes, pkt.Src, pkt.Seq, pkt.TTL, pkt.Rtt)
+		}
+		pinger.OnRecvError = func(e *ping.PacketError) {
+			fmt.Printf("From %s: icmp_seq=%d %v\n", e.Src, e.Seq, e.Type)
+		}
 	}
 	pinger.OnFinish = func(stats *ping.Statistics) {
 		fmt.Printf("\n--- %s ping statistics ---\n", stats.Addr)
@@ -71,14 +108,49 @@ func main() {
 
 	pinger.Count = *count
 	pinger.Interval = *interval
+	pinger.Flood = *flood
 	pinger.SetPrivileged(*privileged)
 
+	err = pinger.SetPayloadSize(*size)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err.Error())
+		os.Exit(2)
+		return
+	}
+
+	patternBytes, err := hex.DecodeString(*pattern)
+	if err != nil {
+		fmt.Printf("ERROR: Invalid pattern: %s\n", err.Error())
+		os.Exit(2)
+		return
+	}
+	pinger.SetPayloadPattern(patternBytes)
+
+	err = pinger.SetTrafficClass(*tos)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err.Error())
+		os.Exit(2)
+		return
+	}
+
+	// Like the unix ping command, -I takes either an address or an interface
+	if net.ParseIP(*source) != nil {
+		err = pinger.SetSource(*source)
+	} else {
+		err = pinger.SetInterface(*source)
+	}
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err.Error())
+		os.Exit(2)
+		return
+	}
+
 	fmt.Printf("PING %s (%s):\n", pinger.Addr(), pinger.IPAddr())
 
 	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
 	defer cancel()
 
-	err = pinger.RunContext(ctx)
+	_, err = pinger.RunContext(ctx)
 	if err != nil {
 		fmt.Printf("ERROR: %s\n", err.Error())
 		os.Exit(3)
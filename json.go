@@ -0,0 +1,114 @@
+package ping
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+)
+
+// statisticsJSON is the JSON form of Statistics. Round-trip times are in
+// milliseconds, so they're readable and don't depend on Go's time.Duration.
+type statisticsJSON struct {
+	Addr                  string         `json:"addr"`
+	IPAddr                string         `json:"ip_addr"`
+	PacketsSent           int            `json:"packets_sent"`
+	PacketsRecv           int            `json:"packets_recv"`
+	PacketsRecvDuplicates int            `json:"packets_recv_duplicates"`
+	PacketsCorrupt        int            `json:"packets_corrupt"`
+	PacketsReordered      int            `json:"packets_reordered"`
+	PacketsExcluded       int            `json:"packets_excluded"`
+	PacketLoss            float64        `json:"packet_loss"`
+	ConsecutiveLoss       int            `json:"consecutive_loss"`
+	MaxConsecutiveLoss    int            `json:"max_consecutive_loss"`
+	Losses                map[string]int `json:"losses"`
+	MinRtt                float64        `json:"min_rtt_ms"`
+	MaxRtt                float64        `json:"max_rtt_ms"`
+	AvgRtt                float64        `json:"avg_rtt_ms"`
+	StdDevRtt             float64        `json:"stddev_rtt_ms"`
+	Jitter                float64        `json:"jitter_ms"`
+	P50Rtt                float64        `json:"p50_rtt_ms"`
+	P90Rtt                float64        `json:"p90_rtt_ms"`
+	P95Rtt                float64        `json:"p95_rtt_ms"`
+	P99Rtt                float64        `json:"p99_rtt_ms"`
+	Rtts                  []float64      `json:"rtts_ms"`
+	Sources               []sourceJSON   `json:"sources,omitempty"`
+}
+
+// sourceJSON is the JSON form of SourceStatistics.
+type sourceJSON struct {
+	IPAddr                string  `json:"ip_addr"`
+	PacketsRecv           int     `json:"packets_recv"`
+	PacketsRecvDuplicates int     `json:"packets_recv_duplicates"`
+	PacketLoss            float64 `json:"packet_loss"`
+	MinRtt                float64 `json:"min_rtt_ms"`
+	MaxRtt                float64 `json:"max_rtt_ms"`
+	AvgRtt                float64 `json:"avg_rtt_ms"`
+	StdDevRtt             float64 `json:"stddev_rtt_ms"`
+}
+
+// MarshalJSON encodes the statistics as a JSON object with snake_case keys.
+// Round-trip times are given in milliseconds to the nearest microsecond, with
+// an "_ms" suffix on their keys, IPAddr is given as a plain string and
+// PacketLoss is rounded to two decimal places. Losses is keyed by the
+// LossReason's String. Sources, which are encoded the same way, are left out
+// unless the target was a broadcast or multicast address.
+func (s Statistics) MarshalJSON() ([]byte, error) {
+	out := statisticsJSON{
+		Addr:                  s.Addr,
+		PacketsSent:           s.PacketsSent,
+		PacketsRecv:           s.PacketsRecv,
+		PacketsRecvDuplicates: s.PacketsRecvDuplicates,
+		PacketsCorrupt:        s.PacketsCorrupt,
+		PacketsReordered:      s.PacketsReordered,
+		PacketsExcluded:       s.PacketsExcluded,
+		PacketLoss:            round(s.PacketLoss, 2),
+		ConsecutiveLoss:       s.ConsecutiveLoss,
+		MaxConsecutiveLoss:    s.MaxConsecutiveLoss,
+		Losses:                make(map[string]int, len(s.Losses)),
+		MinRtt:                durationToMs(s.MinRtt),
+		MaxRtt:                durationToMs(s.MaxRtt),
+		AvgRtt:                durationToMs(s.AvgRtt),
+		StdDevRtt:             durationToMs(s.StdDevRtt),
+		Jitter:                durationToMs(s.Jitter),
+		P50Rtt:                durationToMs(s.P50Rtt),
+		P90Rtt:                durationToMs(s.P90Rtt),
+		P95Rtt:                durationToMs(s.P95Rtt),
+		P99Rtt:                durationToMs(s.P99Rtt),
+		Rtts:                  make([]float64, len(s.Rtts)),
+	}
+	if s.IPAddr != nil {
+		out.IPAddr = s.IPAddr.String()
+	}
+	for reason, n := range s.Losses {
+		out.Losses[reason.String()] = n
+	}
+	for i, rtt := range s.Rtts {
+		out.Rtts[i] = durationToMs(rtt)
+	}
+	for _, src := range s.Sources {
+		source := sourceJSON{
+			PacketsRecv:           src.PacketsRecv,
+			PacketsRecvDuplicates: src.PacketsRecvDuplicates,
+			PacketLoss:            round(src.PacketLoss, 2),
+			MinRtt:                durationToMs(src.MinRtt),
+			MaxRtt:                durationToMs(src.MaxRtt),
+			AvgRtt:                durationToMs(src.AvgRtt),
+			StdDevRtt:             durationToMs(src.StdDevRtt),
+		}
+		if src.IPAddr != nil {
+			source.IPAddr = src.IPAddr.String()
+		}
+		out.Sources = append(out.Sources, source)
+	}
+	return json.Marshal(out)
+}
+
+// durationToMs converts d to milliseconds, to the nearest microsecond.
+func durationToMs(d time.Duration) float64 {
+	return round(float64(d)/float64(time.Millisecond), 3)
+}
+
+func round(f float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+	return math.Round(f*scale) / scale
+}
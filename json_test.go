@@ -0,0 +1,84 @@
+package ping
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatisticsMarshalJSON(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+
+	p.PacketsSent = 3
+	p.PacketsRecv = 2
+	p.rtts = []time.Duration{1500 * time.Microsecond, 2*time.Millisecond + 1234}
+	p.countLoss(2, LossNoReply)
+
+	b, err := json.Marshal(p.Statistics())
+	AssertNoError(t, err)
+
+	var out map[string]interface{}
+	AssertNoError(t, json.Unmarshal(b, &out))
+
+	AssertEqualStrings(t, "127.0.0.1", out["addr"].(string))
+	AssertEqualStrings(t, "127.0.0.1", out["ip_addr"].(string))
+	expected := map[string]float64{
+		"packets_sent": 3,
+		"packets_recv": 2,
+		"packet_loss":  33.33,
+		"min_rtt_ms":   1.5,
+		"max_rtt_ms":   2.001,
+		"p50_rtt_ms":   1.5,
+	}
+	for key, v := range expected {
+		if got, ok := out[key].(float64); !ok || got != v {
+			t.Errorf("%s: expected %v, got %v", key, v, out[key])
+		}
+	}
+
+	rtts, ok := out["rtts_ms"].([]interface{})
+	if !ok || len(rtts) != 2 {
+		t.Fatalf("Expected 2 rtts, got %v", out["rtts_ms"])
+	}
+	if rtts[0].(float64) != 1.5 {
+		t.Errorf("Expected %v, got %v", 1.5, rtts[0])
+	}
+
+	losses, ok := out["losses"].(map[string]interface{})
+	if !ok || losses["no reply"] != float64(1) {
+		t.Errorf("Expected 1 loss with no reply, got %v", out["losses"])
+	}
+
+	// An empty Statistics shouldn't produce nulls or fail to encode
+	b, err = json.Marshal(Statistics{IPAddr: &net.IPAddr{IP: net.IPv6loopback}})
+	AssertNoError(t, err)
+	out = nil
+	AssertNoError(t, json.Unmarshal(b, &out))
+	AssertEqualStrings(t, "::1", out["ip_addr"].(string))
+	if _, ok := out["rtts_ms"].([]interface{}); !ok {
+		t.Errorf("Expected an empty list of rtts, got %v", out["rtts_ms"])
+	}
+	if _, ok := out["sources"]; ok {
+		t.Errorf("Expected no sources, got %v", out["sources"])
+	}
+
+	b, err = json.Marshal(Statistics{Sources: []SourceStatistics{{
+		IPAddr:      &net.IPAddr{IP: net.ParseIP("192.0.2.7")},
+		PacketsRecv: 2,
+		AvgRtt:      1500 * time.Microsecond,
+	}}})
+	AssertNoError(t, err)
+	out = nil
+	AssertNoError(t, json.Unmarshal(b, &out))
+	sources, ok := out["sources"].([]interface{})
+	if !ok || len(sources) != 1 {
+		t.Fatalf("Expected 1 source, got %v", out["sources"])
+	}
+	source := sources[0].(map[string]interface{})
+	AssertEqualStrings(t, "192.0.2.7", source["ip_addr"].(string))
+	if source["packets_recv"] != float64(2) || source["avg_rtt_ms"] != 1.5 {
+		t.Errorf("Expected 2 packets and an average of 1.5ms, got %v", source)
+	}
+}
@@ -0,0 +1,55 @@
+package ping
+
+import (
+	"log"
+)
+
+// Logger is used by Pinger to log what it's doing. Debugf is only called when
+// Pinger's Debug field is true.
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Printf(format string, v ...interface{})
+}
+
+// StdLogger is a Logger which writes to a *log.Logger from the standard
+// library, or to the log package's standard logger if Logger is nil:
+//
+//	pinger.Debug = true
+//	pinger.SetLogger(ping.StdLogger{})
+type StdLogger struct {
+	Logger *log.Logger
+}
+
+// Printf logs a message.
+func (l StdLogger) Printf(format string, v ...interface{}) {
+	if l.Logger == nil {
+		log.Printf(format, v...)
+		return
+	}
+	l.Logger.Printf(format, v...)
+}
+
+// Debugf logs a message with a "DEBUG: " prefix.
+func (l StdLogger) Debugf(format string, v ...interface{}) {
+	l.Printf("DEBUG: "+format, v...)
+}
+
+// SetLogger sets the Logger pinger logs to. By default, or if logger is nil,
+// pinger doesn't log anything.
+func (p *Pinger) SetLogger(logger Logger) {
+	p.logger = logger
+}
+
+// debugf logs a debug message if pinger is in debug mode and has a logger.
+func (p *Pinger) debugf(format string, v ...interface{}) {
+	if p.Debug && p.logger != nil {
+		p.logger.Debugf(format, v...)
+	}
+}
+
+// printf logs a message if pinger has a logger.
+func (p *Pinger) printf(format string, v ...interface{}) {
+	if p.logger != nil {
+		p.logger.Printf(format, v...)
+	}
+}
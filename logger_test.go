@@ -0,0 +1,57 @@
+package ping
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+func TestLogger(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.Count = 2
+	p.Interval = 10 * time.Millisecond
+	p.SetConn(newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		return []*icmp.Message{echoReply(req)}
+	}))
+
+	var buf bytes.Buffer
+	p.SetLogger(StdLogger{Logger: log.New(&buf, "", 0)})
+
+	// Nothing should be logged outside debug mode
+	_, err = p.Run()
+	AssertNoError(t, err)
+	if buf.Len() != 0 {
+		t.Errorf("Expected no output, got %q", buf.String())
+	}
+
+	AssertNoError(t, p.Reset())
+	p.Debug = true
+	_, err = p.Run()
+	AssertNoError(t, err)
+
+	garbage := []byte{0}
+	AssertError(t, p.processPacket(&packet{bytes: garbage, nbytes: len(garbage)}), "garbage")
+
+	expected := []string{
+		"DEBUG: Sent 16 bytes to 127.0.0.1: icmp_seq=0",
+		"DEBUG: Received 16 bytes from 127.0.0.1: icmp_seq=0 time=",
+		"DEBUG: Sent 16 bytes to 127.0.0.1: icmp_seq=1",
+		"DEBUG: Received 16 bytes from 127.0.0.1: icmp_seq=1 time=",
+		"DEBUG: Error parsing ICMP message from <nil>: ",
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %v lines, got %q", len(expected), lines)
+	}
+	for i := range expected {
+		if !strings.HasPrefix(lines[i], expected[i]) {
+			t.Errorf("Expected a line starting with %q, got %q", expected[i], lines[i])
+		}
+	}
+}
@@ -9,8 +9,7 @@
 //	}
 //
 //	pinger.Count = 3
-//	pinger.Run() // blocks until finished
-//	stats := pinger.Statistics() // get send/receive/rtt stats
+//	stats, err := pinger.Run() // blocks until finished, returns send/receive/rtt stats
 //
 // Here is an example that emulates the unix ping command:
 //
@@ -44,13 +43,16 @@
 package ping
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"math"
-	"math/rand"
 	"net"
+	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -70,22 +72,110 @@ var (
 	ipv6Proto = map[string]string{"ip": "ip6:ipv6-icmp", "udp": "udp6"}
 )
 
+const (
+	// floodMinInterval is the least time flood mode waits between packets,
+	// so a fast network can't keep the CPU busy.
+	floodMinInterval = time.Millisecond
+
+	// floodMaxInterval is the most time flood mode waits for a reply before
+	// sending the next packet anyway.
+	floodMaxInterval = 10 * time.Millisecond
+
+	// sendMaxRetries is how many times sending an echo request is retried when
+	// there's no buffer space for it, and sendRetryBackoff is how long to wait
+	// before the first retry. The wait doubles for each retry after that.
+	sendMaxRetries   = 5
+	sendRetryBackoff = time.Millisecond
+
+	// maxDuration is the longest time.Duration there is.
+	maxDuration = time.Duration(math.MaxInt64)
+)
+
+// ErrTimeout is returned by Run when its fallback timeout expires before the
+// run finishes. If the context passed to RunContext is done instead, its error
+// is returned.
+var ErrTimeout = errors.New("Ping timeout")
+
+// Conn is a connection which a Pinger sends echo requests and receives ICMP
+// messages on. *icmp.PacketConn implements it.
+//
+// In privileged mode, ReadFrom should return ICMP messages, optionally
+// preceded by an IPv4 header, from *net.IPAddr addresses, and WriteTo is given
+// *net.IPAddr destinations. In unprivileged mode, *net.UDPAddr is used instead.
+type Conn interface {
+	ReadFrom(b []byte) (n int, addr net.Addr, err error)
+	WriteTo(b []byte, dst net.Addr) (n int, err error)
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
 // NewPinger returns a new Pinger struct pointer
 func NewPinger(addr string) (*Pinger, error) {
-	p := &Pinger{
+	p := newPinger()
+	err := p.SetAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// newPinger returns a Pinger with the default settings and no target.
+func newPinger() *Pinger {
+	return &Pinger{
 		Interval: time.Second,
 		Count:    -1,
 
 		network: "udp",
 		size:    timeSliceLength,
+		id:      newID(),
+		now:     time.Now,
+	}
+}
+
+// Ping sends a single unprivileged echo request to addr and returns the
+// round-trip time of the reply. The context is used both to resolve addr and to
+// wait for the reply. If there's no reply before the context's deadline, or
+// within 3 seconds if it has none, Ping returns ErrTimeout.
+func Ping(ctx context.Context, addr string) (time.Duration, error) {
+	p := newPinger()
+	if err := p.SetAddrContext(ctx, addr); err != nil {
+		return 0, err
 	}
+	p.Count = 1
+	return p.pingOnce(ctx)
+}
 
-	err := p.SetAddr(addr)
+// pingOnce implements Ping for a pinger with a Count of 1. The fallback timeout
+// is only used if ctx has no deadline of its own, so a longer deadline isn't
+// cut short.
+func (p *Pinger) pingOnce(ctx context.Context) (time.Duration, error) {
+	var timeout time.Duration
+	if _, ok := ctx.Deadline(); !ok {
+		timeout, _ = p.fallbackTimeout()
+	}
+	stats, err := p.runContext(ctx, timeout, nil)
+	if err == context.DeadlineExceeded {
+		err = ErrTimeout
+	}
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	if len(stats.Rtts) == 0 {
+		// The run ended cleanly without a reply, which shouldn't happen
+		return 0, ErrTimeout
 	}
+	return stats.Rtts[0], nil
+}
 
-	return p, nil
+// lastID is used to give every Pinger in the process a different ICMP ID.
+var lastID uint32
+
+// newID returns an ICMP ID for a new Pinger. Like the unix ping command, it's
+// based on the process ID, so pingers in different processes are unlikely to
+// collide.
+func newID() int {
+	return (os.Getpid() + int(atomic.AddUint32(&lastID, 1))) & 0xffff
 }
 
 // Pinger represents ICMP packet sender/receiver
@@ -98,40 +188,334 @@ type Pinger struct {
 	// interrupted.
 	Count int
 
-	// Debug runs in debug mode
+	// ExpectedRtt is the longest round-trip time Run should expect. It is added
+	// to Run's fallback timeout so the last replies on high-latency paths,
+	// which may arrive well after the last packet is sent, aren't cut off.
+	ExpectedRtt time.Duration
+
+	// Flood sends each echo request as soon as the reply to the previous one
+	// arrives, instead of waiting for Interval, like the -f flag of the unix
+	// ping command. Packets are still sent at least every 10ms, so a lost
+	// packet doesn't stall the run, and at most every 1ms. Run's fallback
+	// timeout is still based on Interval.
+	Flood bool
+
+	// Timeout is how long to wait for the reply to each echo request. A packet
+	// whose reply hasn't arrived by then is counted as lost with LossTimeout,
+	// and a reply arriving after that is ignored. If it isn't set, pinger
+	// waits for replies until it finishes.
+	Timeout time.Duration
+
+	// Deadline is the longest pinger will run for, however many packets have
+	// been sent or received. When it elapses, pinger stops as if Stop had been
+	// called, so Run and RunContext return without an error. If Count is also
+	// set, whichever comes first ends the run, and Run's fallback timeout
+	// isn't used.
+	Deadline time.Duration
+
+	// StopAfterRecv stops pinger as soon as it has received StopAfterRecv
+	// replies, even if Count hasn't been reached. Like Deadline, it stops the
+	// run as if Stop had been called, so Run and RunContext return without an
+	// error and OnFinish gets the statistics so far.
+	StopAfterRecv int
+
+	// StopBelowRtt stops pinger, in the same way as StopAfterRecv, as soon as
+	// it receives a reply with a round-trip time below StopBelowRtt.
+	StopBelowRtt time.Duration
+
+	// ResolveInterval is how often to resolve the target host's address again
+	// while running, with ReResolve, so long runs follow DNS changes. If it
+	// isn't set, the address is only resolved by SetAddr.
+	ResolveInterval time.Duration
+
+	// StatsInterval is how often to pass the statistics so far to OnStats
+	// while running. If it isn't set, OnStats isn't called.
+	StatsInterval time.Duration
+
+	// NoFallbackTimeout disables Run's fallback timeout, so when Count is
+	// specified Run only returns once Count replies have been received.
+	NoFallbackTimeout bool
+
+	// VerifyPayload checks that the data echoed in each reply, after the
+	// timestamp, matches the payload pinger sent. A reply which doesn't is
+	// counted in PacketsCorrupt and as lost with LossCorrupt rather than as
+	// received, and passed to OnCorrupt instead of OnRecv.
+	VerifyPayload bool
+
+	// Debug runs in debug mode, which logs every packet sent and received,
+	// and any which are ignored, to the logger set with SetLogger
 	Debug bool
 
-	// Number of packets sent
+	// DryRun tells pinger to build each echo packet and call OnSend without
+	// opening a socket or sending anything. The packets are built one after
+	// another without waiting for Interval: Count of them, or a single packet
+	// if Count isn't set. PacketsSent counts the packets which would have been
+	// sent, but since none are, none of them are counted as lost.
+	DryRun bool
+
+	// Number of packets sent. Reading this (or PacketsRecv) while pinger is
+	// running is a data race; use Statistics instead.
 	PacketsSent int
 
 	// Number of packets received
 	PacketsRecv int
 
-	// rtts is all of the Rtts
-	rtts []time.Duration
-
-	// OnRecv is called when Pinger receives and processes a packet
+	// Number of duplicate packets received
+	PacketsRecvDuplicates int
+
+	// Number of corrupt packets received, if VerifyPayload is set
+	PacketsCorrupt int
+
+	// rtts is all of the Rtts, or if statsLimit is set, a ring of the last
+	// statsLimit of them, with the oldest at rttsNext once it's full.
+	rtts       []time.Duration
+	rttsNext   int
+	statsLimit int
+
+	// summary aggregates every round-trip time, for when rtts doesn't have
+	// them all.
+	summary rttSummary
+
+	// outstanding maps the sequence numbers which have been sent but not yet
+	// received to the time they were sent.
+	outstanding map[int]time.Time
+
+	// losses is the number of packets counted as lost, by reason.
+	losses map[LossReason]int
+
+	// excluded is the number of packets LossClassifier excluded from the loss
+	// statistics.
+	excluded int
+
+	// consecutiveLoss is the number of packets which have timed out since the
+	// last reply, and maxConsecutiveLoss is the most there have been.
+	consecutiveLoss    int
+	maxConsecutiveLoss int
+
+	// lastRecvSeq is the latest sequence number a reply has been received for,
+	// if recvAny is set, and reordered is the number of replies received after
+	// a reply to a later one.
+	lastRecvSeq int
+	recvAny     bool
+	reordered   int
+
+	// expired is the set of sequence numbers which timed out, so late replies
+	// to them can be ignored. Like outstanding, it only holds sequence numbers
+	// within replyWindow of the last one sent.
+	expired map[int]bool
+
+	// replyTTLs maps the sequence numbers which have been answered to the TTL
+	// of their reply, so duplicates can be compared with it. It's only kept
+	// if OnDuplicateAddr is set, and is pruned like expired.
+	replyTTLs map[int]int
+
+	// group is whether the target is a broadcast or multicast address, so
+	// replies are tracked per source. See SetAddr.
+	group bool
+
+	// groupSent maps the most recent groupHistory sequence numbers sent to a
+	// group to the time they were sent, since unlike outstanding they have to
+	// be remembered after the first reply.
+	groupSent map[int]time.Time
+
+	// sources is every host which has replied to a group, in the order they
+	// first replied, and sourceIndex finds them by address. They're guarded
+	// by mu.
+	sources     []*source
+	sourceIndex map[string]*source
+
+	// OnSend is called when Pinger sends a packet. While running, packets are
+	// sent from a goroutine of their own, so OnSend may be called at the same
+	// time as the other callbacks.
+	OnSend func(*Packet)
+
+	// OnRecv is called when Pinger receives and processes a packet. Like the
+	// other callbacks, it's optional: replies are counted in the statistics
+	// whether it's set or not, so leaving it nil and only setting OnFinish
+	// gives a quiet ping which just reports the summary.
 	OnRecv func(*Packet)
 
+	// OnCorrupt is called when a reply is received whose payload doesn't match
+	// what was sent, if VerifyPayload is set.
+	OnCorrupt func(*Packet)
+
+	// OnDuplicateRecv is called when Pinger receives a reply to an echo
+	// request which has already been answered. Duplicates aren't counted in
+	// PacketsRecv or the round-trip time statistics.
+	OnDuplicateRecv func(*Packet)
+
+	// OnDuplicateAddr is called, after OnDuplicateRecv, when a duplicate
+	// reply has a different TTL to the first reply to the same echo request.
+	// Replies which took different routes back, or came from hosts a
+	// different number of hops away, suggest more than one host has the
+	// target's address. It's passed the duplicate and the TTL of the first
+	// reply. This is only a heuristic: it needs the TTL of replies, which
+	// isn't known on every platform or with a Conn set with SetConn, and it
+	// misses responders which happen to be the same distance away. Broadcast
+	// and multicast targets aren't checked, since many hosts answer them
+	// anyway.
+	OnDuplicateAddr func(pkt *Packet, firstTTL int)
+
+	// OnTimeout is called with the sequence number of each packet whose reply
+	// didn't arrive within Timeout
+	OnTimeout func(seq int)
+
+	// OnLossStreak is called with the number of consecutive packets which have
+	// timed out each time another one does, and with 0 when a reply arrives
+	// after one or more have, so an outage can be detected as it starts and
+	// ends. Only packets which time out count, so it's only called if Timeout
+	// is set.
+	OnLossStreak func(consecutive int)
+
 	// OnFinish is called when Pinger exits
 	OnFinish func(*Statistics)
 
+	// OnStats is called every StatsInterval while Pinger is running, with the
+	// same snapshot Statistics would return, for live updates. It isn't
+	// called once the run is over; OnFinish gets the final statistics.
+	OnStats func(*Statistics)
+
+	// OnRecvError is called when Pinger receives an ICMP error message, such
+	// as Destination Unreachable or Time Exceeded, in response to one of its
+	// echo requests
+	OnRecvError func(*PacketError)
+
+	// LossClassifier is called for each packet which is about to be counted as
+	// lost, with its sequence number and the reason it's considered lost. Like
+	// OnSend, it may be called from the goroutine which sends packets. If it
+	// returns false, the packet is excluded from the loss statistics entirely,
+	// which can be used to separate known non-responses (such as ICMP rate
+	// limiting) from real drops. If it isn't set, every such packet is counted
+	// as lost.
+	LossClassifier func(seq int, reason LossReason) bool
+
+	// OnMessage is called for every ICMP message Pinger successfully parses,
+	// along with the address it was received from, before any type-specific
+	// handling. This allows access to message types Pinger doesn't otherwise
+	// handle. The message's body may reference the receive buffer, so it must
+	// be copied if retained after OnMessage returns.
+	OnMessage func(*icmp.Message, net.Addr)
+
 	ipaddr *net.IPAddr
 	addr   string
+	conn   Conn
+	logger Logger
+
+	// mu guards the statistics (PacketsSent, PacketsRecv,
+	// PacketsRecvDuplicates, rtts, losses and excluded) against concurrent
+	// calls to Statistics, along with cancel and stopped, which are used to
+	// implement Stop and to tell whether pinger is running. Only the run
+	// itself writes the statistics, so it can read them without the lock,
+	// except that PacketsSent is written by the goroutine which sends. That
+	// goroutine also shares sequence, outstanding, expired and groupSent with
+	// the rest of the run, so they're guarded by mu as well.
+	mu      sync.Mutex
+	cancel  context.CancelFunc
+	stopped bool
+
+	// ran is whether a run has finished since pinger was created or Reset,
+	// after which Stop only applies to a run in progress.
+	ran bool
+
+	// hook is passed the current run's events. See startRun.
+	hook func(Event)
 
 	ipv4     bool
 	source   string
+	iface    string
 	size     int
+	pattern  []byte
 	sequence int
 	network  string
+	code     int
+	id       int
+	ttl      int
+	tc       int
+	df       bool
+	mark     uint32
+
+	readBufferSize int
+
+	// now is the clock round-trip times are measured with. See SetClock.
+	now func() time.Time
+
+	// resolver and family are used to resolve the target host's address, and
+	// are guarded by mu. See SetResolver and SetNetwork.
+	resolver *net.Resolver
+	family   string
+}
+
+// groupHistory is how many of the most recent echo requests to a group
+// replies are matched against. Replies to older ones are ignored.
+const groupHistory = 256
+
+// source is a host which has replied to a group.
+type source struct {
+	ipaddr  *net.IPAddr
+	recv    int
+	dups    int
+	summary rttSummary
+
+	// seen is the set of recent sequence numbers this host has replied to.
+	seen map[int]bool
+}
+
+// see records that the host has replied to seq, and returns whether it already
+// had.
+func (s *source) see(seq int) bool {
+	if s.seen[seq] {
+		return true
+	}
+	if len(s.seen) >= groupHistory {
+		for old := range s.seen {
+			if old <= seq-groupHistory {
+				delete(s.seen, old)
+			}
+		}
+	}
+	s.seen[seq] = true
+	return false
 }
 
 type packet struct {
 	bytes  []byte
 	nbytes int
+	addr   net.Addr
+	ttl    int
+
+	// buf is where bytes came from, if it should go back to recvBuffers once
+	// the packet has been processed.
+	buf *[]byte
+}
+
+// recvBuffers holds buffers for recvICMP to read into, so they don't have to
+// be allocated for every packet.
+var recvBuffers = sync.Pool{
+	New: func() interface{} { return new([]byte) },
+}
+
+// newRecvBuffer returns a buffer from recvBuffers which is size bytes long.
+func newRecvBuffer(size int) *[]byte {
+	buf := recvBuffers.Get().(*[]byte)
+	if cap(*buf) < size {
+		*buf = make([]byte, size)
+	}
+	*buf = (*buf)[:size]
+	return buf
+}
+
+// release returns the packet's buffer to recvBuffers. Nothing may use its
+// bytes after this, so whatever is taken from them has to be copied.
+func (r *packet) release() {
+	if r.buf != nil {
+		recvBuffers.Put(r.buf)
+		r.buf = nil
+		r.bytes = nil
+	}
 }
 
-// Packet represents a received and processed ICMP echo packet.
+// Packet represents a received and processed ICMP echo packet. Packets passed
+// to OnSend represent echo requests, so they have no Rtt.
 type Packet struct {
 	// Rtt is the round-trip time it took to ping.
 	Rtt time.Duration
@@ -139,13 +523,70 @@ type Packet struct {
 	// IPAddr is the address of the host being pinged.
 	IPAddr *net.IPAddr
 
+	// Src is the address the reply came from. This is usually IPAddr, but
+	// can differ, such as for anycast targets or when another host answers on
+	// the target's behalf. It's nil for packets passed to OnSend.
+	Src *net.IPAddr
+
 	// NBytes is the number of bytes in the message.
 	Nbytes int
 
-	// Seq is the ICMP sequence number.
+	// Seq is the ICMP sequence number. It counts up from 0 for every echo
+	// request pinger sends, without wrapping around, though only its low 16
+	// bits are sent.
+	Seq int
+
+	// Type is the ICMP type of the message, such as ipv4.ICMPTypeEchoReply,
+	// or ipv4.ICMPTypeEcho for packets passed to OnSend.
+	Type icmp.Type
+
+	// Code is the ICMP code of the reply.
+	Code int
+
+	// ID is the ICMP identifier of the message. In unprivileged mode on
+	// Linux, it's the one the kernel assigned rather than pinger's own.
+	ID int
+
+	// TTL is the IP time-to-live (or hop limit for IPv6) of the reply, or 0 if
+	// it isn't known.
+	TTL int
+
+	// OutOfOrder is whether a reply to a later echo request was received
+	// before this one.
+	OutOfOrder bool
+
+	// Privileged is whether the reply was received on a privileged raw
+	// socket, rather than an unprivileged one. See SetPrivileged.
+	Privileged bool
+}
+
+// PacketError represents a received ICMP error message sent in response to
+// one of pinger's echo requests.
+type PacketError struct {
+	// Type is the ICMP type of the error, such as
+	// ipv4.ICMPTypeDestinationUnreachable or ipv6.ICMPTypeTimeExceeded.
+	Type icmp.Type
+
+	// Code is the ICMP code of the error.
+	Code int
+
+	// Src is the address of the host which sent the error. This is often a
+	// router along the path rather than the host being pinged.
+	Src *net.IPAddr
+
+	// IPAddr is the address of the host being pinged.
+	IPAddr *net.IPAddr
+
+	// Seq is the ICMP sequence number of the echo request which caused the
+	// error, or -1 if it couldn't be determined from the error.
 	Seq int
 }
 
+func (e *PacketError) Error() string {
+	return fmt.Sprintf("%v (code %d) from %v for icmp_seq=%d to %v",
+		e.Type, e.Code, e.Src, e.Seq, e.IPAddr)
+}
+
 // Statistics represent the stats of a currently running or finished
 // pinger operation.
 type Statistics struct {
@@ -155,16 +596,45 @@ type Statistics struct {
 	// PacketsSent is the number of packets sent.
 	PacketsSent int
 
-	// PacketLoss is the percentage of packets lost.
+	// PacketsRecvDuplicates is the number of duplicate replies received.
+	PacketsRecvDuplicates int
+
+	// PacketsCorrupt is the number of replies received whose payload didn't
+	// match what was sent. See VerifyPayload.
+	PacketsCorrupt int
+
+	// PacketsReordered is the number of replies received out of order, after
+	// a reply to a later echo request. See Packet.OutOfOrder.
+	PacketsReordered int
+
+	// PacketLoss is the percentage of packets lost. Packets excluded by
+	// LossClassifier are left out of both sides of the calculation.
 	PacketLoss float64
 
+	// PacketsExcluded is the number of packets LossClassifier excluded from
+	// the loss statistics.
+	PacketsExcluded int
+
+	// ConsecutiveLoss is the number of packets which have timed out since the
+	// last reply was received, and MaxConsecutiveLoss is the longest such
+	// streak there has been. See OnLossStreak.
+	ConsecutiveLoss    int
+	MaxConsecutiveLoss int
+
+	// Losses is the number of packets counted as lost, by reason. Packets are
+	// only counted here once they're known to be lost, which for LossNoReply
+	// is when pinger finishes, or 32768 packets later if that's sooner, and
+	// for LossTimeout is after Timeout.
+	Losses map[LossReason]int
+
 	// IPAddr is the address of the host being pinged.
 	IPAddr *net.IPAddr
 
 	// Addr is the string address of the host being pinged.
 	Addr string
 
-	// Rtts is all of the round-trip times sent via this pinger.
+	// Rtts is all of the round-trip times sent via this pinger, or the most
+	// recent of them if there's a limit set with SetStatsBufferLimit.
 	Rtts []time.Duration
 
 	// MinRtt is the minimum round-trip time sent via this pinger.
@@ -176,13 +646,137 @@ type Statistics struct {
 	// AvgRtt is the average round-trip time sent via this pinger.
 	AvgRtt time.Duration
 
+	// TotalRtt is the sum of the round-trip times sent via this pinger,
+	// including any which are no longer in Rtts. Like PacketsRecv, it only
+	// ever goes up while pinger is running.
+	TotalRtt time.Duration
+
 	// StdDevRtt is the standard deviation of the round-trip times sent via
 	// this pinger.
 	StdDevRtt time.Duration
+
+	// Jitter is the mean absolute difference between consecutive round-trip
+	// times, as in RFC 3550. Round-trip times are taken in the order their
+	// replies arrived, not in sequence order. It's 0 with fewer than two
+	// round-trip times.
+	Jitter time.Duration
+
+	// P50Rtt, P90Rtt, P95Rtt and P99Rtt are the 50th, 90th, 95th and 99th
+	// percentile round-trip times sent via this pinger. See Percentile.
+	P50Rtt time.Duration
+	P90Rtt time.Duration
+	P95Rtt time.Duration
+	P99Rtt time.Duration
+
+	// Sources is the statistics of every host which replied, in the order
+	// they first replied, if the target is a broadcast or multicast address.
+	// It's nil otherwise.
+	Sources []SourceStatistics
+}
+
+// SourceStatistics represent the stats of one of the hosts which replied to a
+// broadcast or multicast pinger.
+type SourceStatistics struct {
+	// IPAddr is the address of the host.
+	IPAddr *net.IPAddr
+
+	// PacketsRecv is the number of echo requests the host replied to.
+	PacketsRecv int
+
+	// PacketsRecvDuplicates is the number of duplicate replies received from
+	// the host.
+	PacketsRecvDuplicates int
+
+	// PacketLoss is the percentage of the packets sent which the host didn't
+	// reply to.
+	PacketLoss float64
+
+	// MinRtt, MaxRtt, AvgRtt and StdDevRtt are the minimum, maximum, average
+	// and standard deviation of the host's round-trip times.
+	MinRtt    time.Duration
+	MaxRtt    time.Duration
+	AvgRtt    time.Duration
+	StdDevRtt time.Duration
+}
+
+// LossReason is the reason a packet is considered lost.
+type LossReason int
+
+const (
+	// LossNoReply means no reply to the packet had been received by the time
+	// pinger finished, or by the time so many more packets had been sent that
+	// its reply could no longer be told apart from theirs.
+	LossNoReply LossReason = iota
+
+	// LossTimeout means no reply to the packet was received within Timeout.
+	LossTimeout
+
+	// LossCorrupt means the reply to the packet didn't echo its payload
+	// correctly. See VerifyPayload.
+	LossCorrupt
+)
+
+func (r LossReason) String() string {
+	switch r {
+	case LossNoReply:
+		return "no reply"
+	case LossTimeout:
+		return "timeout"
+	case LossCorrupt:
+		return "corrupt"
+	default:
+		return fmt.Sprintf("LossReason(%d)", int(r))
+	}
 }
 
-// SetIPAddr sets the ip address of the target host.
+// SetIPAddr sets the ip address of the target host. IPv4-mapped IPv6
+// addresses, like "::ffff:127.0.0.1", are pinged over IPv4. If the new address
+// is of a different family to the old one, a source address set with
+// SetSource no longer applies, and running will fail until it's changed.
+// SetIPAddrChecked catches that straight away instead. While pinger is
+// running, its socket is already open for the old family, so a change of
+// family is logged and ignored.
 func (p *Pinger) SetIPAddr(ipaddr *net.IPAddr) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cancel != nil && p.ipaddr != nil && isIPv4(ipaddr.IP) != p.ipv4 {
+		p.printf("Not changing from %s to %s while running, the socket is already open for %s",
+			p.ipaddr, ipaddr, p.ipaddr)
+		return
+	}
+	p.setIPAddr(ipaddr)
+	p.addr = ipaddr.String()
+}
+
+// SetIPAddrChecked is like SetIPAddr, but returns an error and leaves the
+// target as it was if ipaddr isn't an IPv4 or IPv6 address, or if it's of a
+// different family to the current target while pinger is running or has a
+// source address set.
+func (p *Pinger) SetIPAddrChecked(ipaddr *net.IPAddr) error {
+	if ipaddr == nil || (!isIPv4(ipaddr.IP) && !isIPv6(ipaddr.IP)) {
+		return fmt.Errorf("Invalid IP address: %v", ipaddr)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.ipaddr != nil && isIPv4(ipaddr.IP) != p.ipv4 {
+		if p.cancel != nil {
+			return fmt.Errorf("Cannot change from %s to %s while running, the socket is already open for %s",
+				p.ipaddr, ipaddr, p.ipaddr)
+		}
+		if p.source != "" {
+			return fmt.Errorf("Source address %s is not the same family as %s", p.source, ipaddr)
+		}
+	}
+
+	p.setIPAddr(ipaddr)
+	p.addr = ipaddr.String()
+	return nil
+}
+
+func (p *Pinger) setIPAddr(ipaddr *net.IPAddr) {
 	var ipv4 bool
 	if isIPv4(ipaddr.IP) {
 		ipv4 = true
@@ -191,28 +785,181 @@ func (p *Pinger) SetIPAddr(ipaddr *net.IPAddr) {
 	}
 
 	p.ipaddr = ipaddr
-	p.addr = ipaddr.String()
 	p.ipv4 = ipv4
 }
 
 // IPAddr returns the ip address of the target host.
 func (p *Pinger) IPAddr() *net.IPAddr {
+	return p.target()
+}
+
+// target returns the ip address of the target host. Unlike ipaddr, it's safe
+// to use while ReResolve may be changing it.
+func (p *Pinger) target() *net.IPAddr {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	return p.ipaddr
 }
 
+// lookupIPAddr is used to look up the target host's addresses. It's a
+// variable so tests can stub it.
+var lookupIPAddr = func(ctx context.Context, r *net.Resolver, host string) ([]net.IPAddr, error) {
+	return r.LookupIPAddr(ctx, host)
+}
+
 // SetAddr resolves and sets the ip address of the target host, addr can be a
-// DNS name like "www.google.com" or IP like "127.0.0.1".
+// DNS name like "www.google.com" or IP like "127.0.0.1". An IPv6 link-local
+// address needs a zone, like "fe80::1%eth0", which is kept and used to send.
+// See SetAddrContext.
+//
+// addr can also be a broadcast address, like "255.255.255.255" or the
+// broadcast address of one of the host's subnets, or a multicast address, like
+// the IPv6 all-nodes address "ff02::1%eth0", to find every host which
+// replies. Each one is passed to OnRecv with its address in Packet.Src, and
+// has its own statistics in Statistics.Sources. A second reply from the same
+// host is a duplicate, but replies from different hosts aren't. Count is then
+// the number of echo requests sent, rather than replies, and once they're all
+// sent pinger waits the longer of Interval and Timeout for the last replies
+// before it finishes. PacketsRecv counts the requests at least one host
+// replied to. Many hosts ignore broadcast and IPv4 multicast echo requests,
+// and sending them may need privileges on some platforms.
 func (p *Pinger) SetAddr(addr string) error {
-	ipaddr, err := net.ResolveIPAddr("ip", addr)
+	return p.SetAddrContext(context.Background(), addr)
+}
+
+// SetAddrContext is like SetAddr, but the context can be used to give up on
+// resolving addr. If addr has more than one address, the first of the family
+// set with SetNetwork is used.
+func (p *Pinger) SetAddrContext(ctx context.Context, addr string) error {
+	ipaddr, err := p.resolve(ctx, addr)
 	if err != nil {
 		return err
 	}
 
-	p.SetIPAddr(ipaddr)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.setIPAddr(ipaddr)
 	p.addr = addr
 	return nil
 }
 
+// SetResolver sets the resolver used to look up the target host's address, in
+// SetAddr, SetAddrContext and ReResolve. A nil resolver, the default, is
+// net.DefaultResolver. Since NewPinger resolves its address first, call
+// SetAddr again afterwards for the resolver to be used.
+func (p *Pinger) SetResolver(r *net.Resolver) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.resolver = r
+}
+
+// SetNetwork sets which family of address the target host is resolved to:
+// "ip4" for IPv4 only, "ip6" for IPv6 only, or "ip", the default, for either,
+// preferring IPv4. The address is resolved again with the new family, and if
+// that fails, the family is left as it was.
+func (p *Pinger) SetNetwork(network string) error {
+	switch network {
+	case "ip", "ip4", "ip6":
+	default:
+		return fmt.Errorf("Invalid network %q, expected ip, ip4 or ip6", network)
+	}
+
+	p.mu.Lock()
+	prev := p.family
+	p.family = network
+	p.mu.Unlock()
+
+	if err := p.ReResolve(); err != nil {
+		p.mu.Lock()
+		p.family = prev
+		p.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Network returns which family of address the target host is resolved to.
+// See SetNetwork.
+func (p *Pinger) Network() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.family == "" {
+		return "ip"
+	}
+	return p.family
+}
+
+// resolve looks up addr with pinger's resolver and returns its first address
+// of pinger's family.
+func (p *Pinger) resolve(ctx context.Context, addr string) (*net.IPAddr, error) {
+	p.mu.Lock()
+	resolver, family := p.resolver, p.family
+	p.mu.Unlock()
+
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := lookupIPAddr(ctx, resolver, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like net.ResolveIPAddr, IPv4 is preferred if either will do.
+	match := isIPv4
+	if family == "ip6" {
+		match = isIPv6
+	}
+	for _, a := range addrs {
+		if match(a.IP) {
+			return &net.IPAddr{IP: a.IP, Zone: a.Zone}, nil
+		}
+	}
+	if family != "ip4" && family != "ip6" && len(addrs) > 0 {
+		return &net.IPAddr{IP: addrs[0].IP, Zone: addrs[0].Zone}, nil
+	}
+	return nil, &net.AddrError{Err: "no suitable address found", Addr: addr}
+}
+
+// ReResolve resolves the target host's address again, and pings the new
+// address from then on if it has changed. It can be called while pinger is
+// running, but the address can't change between IPv4 and IPv6 mid-run, since
+// the socket is already open for one or the other, so it returns an error
+// instead.
+func (p *Pinger) ReResolve() error {
+	return p.reResolve(context.Background())
+}
+
+// reResolve implements ReResolve. The context can be used to give up on
+// resolving.
+func (p *Pinger) reResolve(ctx context.Context) error {
+	p.mu.Lock()
+	addr := p.addr
+	p.mu.Unlock()
+
+	ipaddr, err := p.resolve(ctx, addr)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cancel == nil {
+		p.setIPAddr(ipaddr)
+		return nil
+	}
+	if isIPv4(ipaddr.IP) != p.ipv4 {
+		return fmt.Errorf("%s now resolves to %s, which can't be pinged on the %s socket",
+			addr, ipaddr, p.ipaddr)
+	}
+	p.ipaddr = ipaddr
+	return nil
+}
+
 // Addr returns the string ip address of the target host.
 func (p *Pinger) Addr() string {
 	return p.addr
@@ -222,6 +969,13 @@ func (p *Pinger) Addr() string {
 // false means pinger will send an "unprivileged" UDP ping.
 // true means pinger will send a "privileged" raw ICMP ping.
 // NOTE: setting to true requires that it be run with super-user privileges.
+//
+// Unprivileged pings use ICMP datagram sockets, which are only available on
+// Linux and darwin. On Linux they also need the net.ipv4.ping_group_range
+// sysctl to include one of the process's groups, and the kernel sets the
+// echo requests' ID itself, so the one set with SetID only applies in
+// privileged mode. Elsewhere, and when they aren't allowed, running returns an
+// error saying so.
 func (p *Pinger) SetPrivileged(privileged bool) {
 	if privileged {
 		p.network = "ip"
@@ -235,270 +989,2050 @@ func (p *Pinger) Privileged() bool {
 	return p.network == "ip"
 }
 
-// Run runs the pinger. This is a blocking function that will exit when it's
-// done. If Count or Interval are not specified, it will run continuously until
-// it is interrupted.
-func (p *Pinger) Run() error {
-	var cancel func()
-	ctx := context.Background()
+// SetSource sets the local IP address pinger sends its echo requests from, for
+// hosts with more than one address. It must be the same family, IPv4 or IPv6,
+// as the target. An empty address lets the system choose, which is the
+// default.
+func (p *Pinger) SetSource(addr string) error {
+	if addr == "" {
+		p.source = ""
+		return nil
+	}
 
-	// Our fallback timeout is the interval times the count plus two (if the
-	// count isn't 0)
-	if p.Count > 0 {
-		ctx, cancel = context.WithTimeout(context.Background(), p.Interval*time.Duration(p.Count+2))
-		defer cancel()
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return fmt.Errorf("Invalid source address: %s", addr)
+	}
+	if err := p.checkSourceFamily(ip); err != nil {
+		return err
 	}
 
-	return p.RunContext(ctx)
+	p.source = addr
+	return nil
 }
 
-// RunContext runs the pinger with the given context. This is a blocking
-// function that will exit when it's done. If Count or Interval are not
-// specified, it will run continuously until it is interrupted. The context
-// passed in can be used for cancellation.
-func (p *Pinger) RunContext(ctx context.Context) error {
-	var conn *icmp.PacketConn
-	var err error
-	if p.ipv4 {
-		if conn, err = p.listen(ipv4Proto[p.network], p.source); err != nil {
-			return err
-		}
-	} else {
-		if conn, err = p.listen(ipv6Proto[p.network], p.source); err != nil {
+// Source returns the local IP address pinger sends its echo requests from, or
+// "" if the system chooses.
+func (p *Pinger) Source() string {
+	return p.source
+}
+
+// checkSourceFamily returns an error if ip can't be used as a source address to
+// ping the target.
+func (p *Pinger) checkSourceFamily(ip net.IP) error {
+	if p.ipv4 != isIPv4(ip) {
+		return fmt.Errorf("Source address %s is not the same family as %s", ip, p.ipaddr)
+	}
+	return nil
+}
+
+// SetInterface binds pinger's socket to the named network interface, such as
+// "eth0", so its echo requests are sent (and replies received) through that
+// interface whatever the routing table says. On Linux this uses
+// SO_BINDTODEVICE, which usually needs root or CAP_NET_RAW. Elsewhere, the
+// socket is bound to the interface's first address of the right family
+// instead, unless a source address is already set. An empty name removes the
+// binding.
+func (p *Pinger) SetInterface(name string) error {
+	if name != "" {
+		if _, err := net.InterfaceByName(name); err != nil {
 			return err
 		}
 	}
-	defer conn.Close()
-	defer p.finish()
 
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-	defer wg.Wait()
+	p.iface = name
+	return nil
+}
 
-	innerCtx, cancel := context.WithCancel(ctx)
-	defer cancel()
+// Interface returns the name of the network interface pinger's socket is bound
+// to, or "" if it isn't bound to one.
+func (p *Pinger) Interface() string {
+	return p.iface
+}
 
-	recv := make(chan *packet, 5)
-	go p.recvICMP(innerCtx, conn, recv, wg)
+// SetConn makes pinger send and receive on conn rather than opening its own
+// socket each run, which is mostly useful for testing. Pinger doesn't close
+// conn. Since pinger doesn't open the socket, SetSource and SetInterface have
+// no effect, and the other socket options are only applied if conn is an
+// *icmp.PacketConn. Passing nil restores the default.
+func (p *Pinger) SetConn(conn Conn) {
+	p.conn = conn
+}
 
-	interval := time.NewTicker(p.Interval)
+// SetClock sets the clock pinger measures round-trip times and timeouts with,
+// in place of time.Now. It can be used to get deterministic round-trip times in
+// tests, or to avoid wall clock steps with a purely monotonic source. Only the
+// differences between the times it returns matter, though they're also sent
+// in each echo request's payload. Passing nil restores time.Now. The clock
+// shouldn't be changed while pinger is running.
+func (p *Pinger) SetClock(now func() time.Time) {
+	if now == nil {
+		now = time.Now
+	}
+	p.now = now
+}
 
-	err = p.sendICMP(conn)
-	if err != nil {
-		return err
+// SetPayloadSize sets the number of data bytes pinger sends in each echo
+// request, like the -s flag of the unix ping command. The first 8 bytes hold a
+// timestamp, so size must be at least 8, which is the default.
+func (p *Pinger) SetPayloadSize(size int) error {
+	if size < timeSliceLength {
+		return fmt.Errorf("Payload size must be at least %d bytes, got %d",
+			timeSliceLength, size)
 	}
 
-	for {
-		select {
-		case <-innerCtx.Done():
-			return errors.New("Ping timeout")
-		case <-interval.C:
-			err = p.sendICMP(conn)
-			if err != nil {
-				return err
-			}
-		case r := <-recv:
-			err = p.processPacket(r)
-			if err != nil {
-				return err
-			}
+	p.size = size
+	return nil
+}
 
-			// If there was a count, we sent all our packets and we got all our
-			// packets then we're done.
-			if p.Count > 0 && p.PacketsSent >= p.Count && p.PacketsRecv >= p.Count {
-				cancel()
-				return nil
-			}
-		}
-	}
+// PayloadSize returns the number of data bytes pinger sends in each echo
+// request.
+func (p *Pinger) PayloadSize() int {
+	return p.size
 }
 
-func (p *Pinger) finish() {
-	handler := p.OnFinish
-	if handler != nil {
-		s := p.Statistics()
-		handler(s)
+// SetReadBufferSize sets the size of the buffer each reply is read into. By
+// default, which is a size of 0, it's big enough for a reply to any payload
+// size set with SetPayloadSize, so this is only needed for replies which are
+// bigger than the request. Replies bigger than the buffer are truncated.
+func (p *Pinger) SetReadBufferSize(size int) error {
+	if size < 0 {
+		return fmt.Errorf("Invalid read buffer size: %d", size)
 	}
+
+	p.readBufferSize = size
+	return nil
 }
 
-// Statistics returns the statistics of the pinger. This can be run while the
-// pinger is running or after it is finished. OnFinish calls this function to
-// get it's finished statistics.
-func (p *Pinger) Statistics() *Statistics {
-	loss := float64(p.PacketsSent-p.PacketsRecv) / float64(p.PacketsSent) * 100
-	var min, max, total time.Duration
-	if len(p.rtts) > 0 {
-		min = p.rtts[0]
-		max = p.rtts[0]
-	}
-	for _, rtt := range p.rtts {
-		if rtt < min {
-			min = rtt
-		}
-		if rtt > max {
-			max = rtt
-		}
-		total += rtt
-	}
-	s := Statistics{
-		PacketsSent: p.PacketsSent,
-		PacketsRecv: p.PacketsRecv,
-		PacketLoss:  loss,
-		Rtts:        p.rtts,
-		Addr:        p.addr,
-		IPAddr:      p.ipaddr,
-		MaxRtt:      max,
-		MinRtt:      min,
-	}
-	if len(p.rtts) > 0 {
-		s.AvgRtt = total / time.Duration(len(p.rtts))
-		var sumsquares time.Duration
-		for _, rtt := range p.rtts {
-			sumsquares += (rtt - s.AvgRtt) * (rtt - s.AvgRtt)
-		}
-		s.StdDevRtt = time.Duration(math.Sqrt(
-			float64(sumsquares / time.Duration(len(p.rtts)))))
+// ReadBufferSize returns the size of the buffer each reply is read into.
+func (p *Pinger) ReadBufferSize() int {
+	return p.recvBufferSize()
+}
+
+// SetPayloadPattern sets the bytes pinger fills the data of each echo request
+// with after the timestamp, like the -p flag of the unix ping command. The
+// pattern is repeated as many times as fits in the payload, and truncated if
+// it doesn't fit once. An empty pattern restores the default, which fills the
+// payload with 0x01.
+func (p *Pinger) SetPayloadPattern(pattern []byte) {
+	if len(pattern) == 0 {
+		p.pattern = nil
+		return
 	}
-	return &s
+
+	p.pattern = make([]byte, len(pattern))
+	copy(p.pattern, pattern)
 }
 
-func (p *Pinger) recvICMP(
-	ctx context.Context,
-	conn *icmp.PacketConn,
-	recv chan<- *packet,
-	wg *sync.WaitGroup,
-) {
-	defer wg.Done()
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			bytes := make([]byte, 512)
-			// TODO: We shouldn't have to do it like this - it's technically
-			// busy waiting for the context to close. We also explicitly ignore
-			// the error for linting reasons.
-			_ = conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
-			n, _, err := conn.ReadFrom(bytes)
-			if err != nil {
-				if neterr, ok := err.(*net.OpError); ok {
-					if neterr.Timeout() {
-						// Read timeout
-						continue
-					} else {
-						return
-					}
-				}
-			}
+// PayloadPattern returns the pattern set with SetPayloadPattern, or nil if it
+// isn't set.
+func (p *Pinger) PayloadPattern() []byte {
+	return p.pattern
+}
 
-			recv <- &packet{bytes: bytes, nbytes: n}
-		}
+// SetTTL sets the IP time-to-live (or hop limit for IPv6) of pinger's echo
+// requests. The TTL must be between 1 and 255. If it isn't set, the system
+// default is used.
+func (p *Pinger) SetTTL(ttl int) error {
+	if ttl < 1 || ttl > 255 {
+		return fmt.Errorf("Invalid TTL: %d", ttl)
 	}
+
+	p.ttl = ttl
+	return nil
 }
 
-func (p *Pinger) processPacket(recv *packet) error {
-	var bytes []byte
-	var proto int
-	if p.ipv4 {
-		if p.network == "ip" {
-			bytes = ipv4Payload(recv.bytes)
+// TTL returns the IP time-to-live pinger sets on its echo requests, or 0 if
+// it uses the system default.
+func (p *Pinger) TTL() int {
+	return p.ttl
+}
+
+// OSProfile is a preset for SetOSProfile, named after the operating system
+// whose ping command it resembles.
+type OSProfile int
+
+const (
+	// OSLinux is the iputils ping command: a TTL of 64 and 56 data bytes,
+	// each byte after the timestamp holding its offset in the data.
+	OSLinux OSProfile = iota
+
+	// OSWindows is the Windows ping command: a TTL of 128 and 32 data bytes
+	// of the repeated alphabet, "abcdefghijklmnopqrstuvw". Windows doesn't
+	// send a timestamp, so the first 8 bytes still differ.
+	OSWindows
+
+	// OSMacOS is the macOS ping command, which uses the same defaults as
+	// OSLinux.
+	OSMacOS
+)
+
+func (o OSProfile) String() string {
+	switch o {
+	case OSLinux:
+		return "linux"
+	case OSWindows:
+		return "windows"
+	case OSMacOS:
+		return "macos"
+	default:
+		return fmt.Sprintf("OSProfile(%d)", int(o))
+	}
+}
+
+// SetOSProfile sets pinger's TTL, payload size and payload pattern to those of
+// another operating system's ping command, using SetTTL, SetPayloadSize and
+// SetPayloadPattern. It only changes what the library controls: everything
+// else about the packets, like the IP ID and which options the IP headers
+// carry, still comes from the host's network stack, so this isn't enough to
+// pass for another OS under full fingerprinting.
+func (p *Pinger) SetOSProfile(profile OSProfile) error {
+	var pattern []byte
+	switch profile {
+	case OSLinux, OSMacOS:
+		p.ttl = 64
+		p.size = 56
+		pattern = make([]byte, p.size-timeSliceLength)
+		for i := range pattern {
+			pattern[i] = byte(timeSliceLength + i)
+		}
+	case OSWindows:
+		p.ttl = 128
+		p.size = 32
+		alphabet := "abcdefghijklmnopqrstuvw"
+		pattern = []byte(alphabet[timeSliceLength:] + alphabet[:timeSliceLength])
+	default:
+		return fmt.Errorf("Unknown OS profile: %v", profile)
+	}
+
+	p.SetPayloadPattern(pattern)
+	return nil
+}
+
+// SetCode sets the ICMP code pinger will send in its echo requests. Echo
+// requests normally use a code of 0, but a non-zero code can be useful for
+// testing how responders and middleboxes handle them. The code must be between
+// 0 and 255.
+func (p *Pinger) SetCode(code int) error {
+	if code < 0 || code > 255 {
+		return fmt.Errorf("Invalid ICMP code: %d", code)
+	}
+
+	p.code = code
+	return nil
+}
+
+// Code returns the ICMP code pinger sends in its echo requests.
+func (p *Pinger) Code() int {
+	return p.code
+}
+
+// SetID sets the ICMP identifier pinger sends in its echo requests, instead of
+// the one picked for it when it was created. This is useful for matching
+// pinger's traffic in a packet capture. It must be between 0 and 65535. In
+// unprivileged mode the kernel replaces the identifier with one of its own,
+// so this has no effect.
+func (p *Pinger) SetID(id int) error {
+	if id < 0 || id > 0xffff {
+		return fmt.Errorf("Invalid ICMP ID: %d", id)
+	}
+
+	p.id = id
+	return nil
+}
+
+// ID returns the ICMP identifier pinger sends in its echo requests.
+func (p *Pinger) ID() int {
+	return p.id
+}
+
+// SetTrafficClass sets the IPv4 type-of-service byte (or IPv6 traffic class)
+// of pinger's echo requests, like the -Q flag of the unix ping command. The
+// DSCP value is the upper six bits, so DSCP EF (46) is a traffic class of 184.
+// It must be between 0 and 255, and defaults to 0.
+func (p *Pinger) SetTrafficClass(tc int) error {
+	if tc < 0 || tc > 255 {
+		return fmt.Errorf("Invalid traffic class: %d", tc)
+	}
+
+	p.tc = tc
+	return nil
+}
+
+// TrafficClass returns the traffic class of pinger's echo requests.
+func (p *Pinger) TrafficClass() int {
+	return p.tc
+}
+
+// SetDoNotFragment sets whether pinger's echo requests are sent with the IPv4
+// Don't Fragment bit set, or for IPv6, whether the kernel is stopped from
+// fragmenting them. Along with SetPayloadSize, this can be used for path MTU
+// discovery: requests too big for the path are answered with a "fragmentation
+// needed" Destination Unreachable or a Packet Too Big error, which is passed to
+// OnRecvError. It's only supported on Linux, and returns an error elsewhere.
+func (p *Pinger) SetDoNotFragment(df bool) error {
+	if df && !dontFragmentSupported {
+		return errors.New("Setting the Don't Fragment bit isn't supported on this platform")
+	}
+
+	p.df = df
+	return nil
+}
+
+// DoNotFragment returns whether pinger's echo requests are sent with the Don't
+// Fragment bit set.
+func (p *Pinger) DoNotFragment() bool {
+	return p.df
+}
+
+// SetMark sets the fwmark of pinger's socket, with SO_MARK, so its packets can
+// be matched by policy routing rules and firewalls. A mark of 0, the default,
+// leaves it unset. Setting a mark needs CAP_NET_ADMIN. It's only supported on
+// Linux, and returns an error elsewhere.
+func (p *Pinger) SetMark(mark uint32) error {
+	if mark != 0 && !markSupported {
+		return errors.New("Setting a socket mark isn't supported on this platform")
+	}
+
+	p.mark = mark
+	return nil
+}
+
+// Mark returns the fwmark of pinger's socket.
+func (p *Pinger) Mark() uint32 {
+	return p.mark
+}
+
+// Run runs the pinger. This is a blocking function that will exit when it's
+// done. If Count or Interval are not specified, it will run continuously until
+// it is interrupted. It returns the same statistics passed to OnFinish.
+//
+// If Count is specified, Run also gives up after a fallback timeout of
+// Interval*(Count+2) plus the longer of ExpectedRtt and Timeout, unless
+// NoFallbackTimeout or Deadline is set. If it does, it returns ErrTimeout.
+func (p *Pinger) Run() (*Statistics, error) {
+	timeout, _ := p.fallbackTimeout()
+	return p.runContext(context.Background(), timeout, nil)
+}
+
+// fallbackTimeout returns the timeout Run should use, and whether it should use
+// one at all.
+func (p *Pinger) fallbackTimeout() (time.Duration, bool) {
+	if p.Count <= 0 || p.NoFallbackTimeout || p.Deadline > 0 {
+		return 0, false
+	}
+
+	// Our fallback timeout is the interval times the count plus two, plus
+	// however long we expect the last reply to take to arrive, which is at
+	// most Timeout if it's set.
+	wait := p.ExpectedRtt
+	if p.Timeout > wait {
+		wait = p.Timeout
+	}
+
+	// If that doesn't fit in a time.Duration the run would take centuries
+	// anyway, so rather than let it wrap around to something tiny or negative
+	// we go without the fallback and rely on the count being reached.
+	n := int64(p.Count) + 2
+	if p.Interval > 0 && n > int64(maxDuration-wait)/int64(p.Interval) {
+		return 0, false
+	}
+	return p.Interval*time.Duration(n) + wait, true
+}
+
+// RunContext runs the pinger with the given context. This is a blocking
+// function that will exit when it's done. If Count or Interval are not
+// specified, it will run continuously until it is interrupted. The context
+// passed in can be used for cancellation. If it's done before the run
+// finishes, its error is returned. If sending fails in a way retrying won't
+// fix, such as permission being denied or the network being unreachable, that
+// error is returned.
+//
+// It returns the same statistics passed to OnFinish, whether the run finished
+// or was cancelled. If the pinger couldn't start at all, the statistics are nil
+// and OnFinish isn't called.
+func (p *Pinger) RunContext(ctx context.Context) (*Statistics, error) {
+	return p.runContext(ctx, 0, nil)
+}
+
+// runContext implements Run and RunContext. If timeout isn't 0, the run gives
+// up with ErrTimeout after that long. If hook isn't nil, it's passed the run's
+// events. See startRun.
+func (p *Pinger) runContext(
+	ctx context.Context,
+	timeout time.Duration,
+	hook func(Event),
+) (*Statistics, error) {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	p.startRun(stop, hook)
+	defer p.endRun()
+
+	if ip := p.target().IP; ip != nil {
+		p.group = ip.IsMulticast() || isBroadcast(ip)
+	}
+
+	if p.DryRun {
+		err := p.dryRun(ctx)
+		return p.finish(), err
+	}
+
+	var source string
+	var err error
+	if p.conn == nil {
+		if source, err = p.listenSource(); err != nil {
+			return nil, err
+		}
+	}
+
+	conn := p.conn
+	if conn == nil {
+		var pc *icmp.PacketConn
+		if p.ipv4 {
+			pc, err = p.listen(ipv4Proto[p.network], source)
 		} else {
-			bytes = recv.bytes
+			pc, err = p.listen(ipv6Proto[p.network], source)
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer pc.Close()
+		conn = pc
+	}
+
+	if pc, ok := conn.(*icmp.PacketConn); ok {
+		if err = p.setSocketOptions(pc); err != nil {
+			return nil, err
+		}
+	}
+
+	err = p.run(ctx, conn, timeout)
+	return p.finish(), err
+}
+
+// listenSource returns the address pinger's socket should listen on. That's
+// the source address if one is set. Otherwise, on platforms which can't bind a
+// socket to an interface directly, it's the address of the interface set with
+// SetInterface.
+func (p *Pinger) listenSource() (string, error) {
+	if p.source != "" {
+		// The target may have changed family since the source was set.
+		if err := p.checkSourceFamily(net.ParseIP(p.source)); err != nil {
+			return "", err
+		}
+		return p.source, nil
+	}
+	if p.iface == "" || bindToDeviceSupported {
+		return "", nil
+	}
+
+	iface, err := net.InterfaceByName(p.iface)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if p.ipv4 && isIPv4(ipnet.IP) {
+			return ipnet.IP.String(), nil
+		}
+		if !p.ipv4 && ipnet.IP.To4() == nil {
+			return ipnet.IP.String(), nil
+		}
+	}
+	return "", fmt.Errorf("Interface %s has no address to ping %s from", p.iface, p.ipaddr)
+}
+
+// setSocketOptions applies pinger's socket options to a newly opened conn.
+func (p *Pinger) setSocketOptions(conn *icmp.PacketConn) error {
+	if p.iface != "" && bindToDeviceSupported {
+		if err := bindToDevice(conn, p.iface); err != nil {
+			return fmt.Errorf("Error binding to interface %s: %s", p.iface, err)
+		}
+	}
+	if p.df {
+		if err := setDontFragment(conn); err != nil {
+			return fmt.Errorf("Error setting Don't Fragment: %s", err)
+		}
+	}
+	if p.mark != 0 {
+		if err := setMark(conn, p.mark); err != nil {
+			return fmt.Errorf("Error setting mark %d: %s", p.mark, err)
+		}
+	}
+
+	target := p.target()
+	multicast := p.group && target.IP.IsMulticast()
+	if p.group && !multicast {
+		if err := setBroadcast(conn); err != nil {
+			return fmt.Errorf("Error enabling broadcast: %s", err)
+		}
+	}
+
+	// Echo requests sent to a multicast group don't need it to be joined,
+	// since the replies come back unicast, but they do have their own TTL and
+	// outgoing interface.
+	var ifi *net.Interface
+	if multicast && p.iface != "" {
+		var err error
+		if ifi, err = net.InterfaceByName(p.iface); err != nil {
+			return err
+		}
+	}
+
+	// Receiving the TTL of replies is best effort, as not every platform
+	// supports it, so errors enabling it are ignored.
+	if p4 := conn.IPv4PacketConn(); p4 != nil {
+		_ = p4.SetControlMessage(ipv4.FlagTTL, true)
+		if p.ttl != 0 {
+			if err := p4.SetTTL(p.ttl); err != nil {
+				return err
+			}
+			if multicast {
+				if err := p4.SetMulticastTTL(p.ttl); err != nil {
+					return err
+				}
+			}
+		}
+		if ifi != nil {
+			if err := p4.SetMulticastInterface(ifi); err != nil {
+				return err
+			}
+		}
+		if p.tc != 0 {
+			return p4.SetTOS(p.tc)
+		}
+		return nil
+	}
+
+	p6 := conn.IPv6PacketConn()
+	_ = p6.SetControlMessage(ipv6.FlagHopLimit, true)
+	if p.ttl != 0 {
+		if err := p6.SetHopLimit(p.ttl); err != nil {
+			return err
+		}
+		if multicast {
+			if err := p6.SetMulticastHopLimit(p.ttl); err != nil {
+				return err
+			}
+		}
+	}
+	if ifi != nil {
+		if err := p6.SetMulticastInterface(ifi); err != nil {
+			return err
+		}
+	}
+	if p.tc != 0 {
+		return p6.SetTrafficClass(p.tc)
+	}
+	return nil
+}
+
+func (p *Pinger) run(ctx context.Context, conn Conn, timeout time.Duration) error {
+	// A conn set with SetConn may still have the deadlines stopRecv left on
+	// it at the end of its last run.
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+	if wd, ok := conn.(writeDeadliner); ok {
+		if err := wd.SetWriteDeadline(time.Time{}); err != nil {
+			return err
+		}
+	}
+
+	wg := &sync.WaitGroup{}
+	innerCtx, cancel := context.WithCancel(ctx)
+	defer stopRecv(cancel, wg, conn)
+
+	recv := make(chan *packet, 5)
+	wg.Add(1)
+	go recvICMP(innerCtx, conn, p.recvBufferSize(), recv, wg)
+
+	// Sending is done in its own goroutine, so a send which blocks can't hold
+	// up receiving or cancellation.
+	flood := make(chan struct{}, 1)
+	sentAll := make(chan struct{})
+	sendErr := make(chan error, 1)
+	wg.Add(1)
+	go p.sendICMPs(innerCtx, conn, flood, sentAll, sendErr, wg)
+
+	// There's no telling how many hosts in a group will reply, so a group
+	// run is never complete. Once Count packets are sent, it lingers for the
+	// longer of Interval and Timeout for the last replies instead.
+	var linger <-chan time.Time
+	var lingerTimer *time.Timer
+	defer func() {
+		if lingerTimer != nil {
+			lingerTimer.Stop()
+		}
+	}()
+
+	var fallback <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		fallback = timer.C
+	}
+
+	var deadline <-chan time.Time
+	if p.Deadline > 0 {
+		timer := time.NewTimer(p.Deadline)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	// The timeout timer is set for when the oldest outstanding packet will
+	// time out. Firing early is harmless, as expire just resets it.
+	var timeouts <-chan time.Time
+	var timeoutTimer *time.Timer
+	if p.Timeout > 0 {
+		timeoutTimer = time.NewTimer(p.Timeout)
+		defer timeoutTimer.Stop()
+		timeouts = timeoutTimer.C
+	}
+
+	// Resolving can be slow, so it's done in the background, one at a time.
+	// A resolve which is still going when the run ends is cancelled, and
+	// waited for so it can't change the target afterwards.
+	var resolveTicks <-chan time.Time
+	if p.ResolveInterval > 0 {
+		resolveTicker := time.NewTicker(p.ResolveInterval)
+		defer resolveTicker.Stop()
+		resolveTicks = resolveTicker.C
+	}
+	resolved := make(chan error, 1)
+	resolving := false
+
+	var statsTicks <-chan time.Time
+	if p.StatsInterval > 0 && p.OnStats != nil {
+		statsTicker := time.NewTicker(p.StatsInterval)
+		defer statsTicker.Stop()
+		statsTicks = statsTicker.C
+	}
+	defer func() {
+		if resolving {
+			cancel()
+			<-resolved
+		}
+	}()
+
+	for {
+		select {
+		case <-innerCtx.Done():
+			if p.stopping() {
+				return nil
+			}
+			return ctx.Err()
+		case <-fallback:
+			return ErrTimeout
+		case <-deadline:
+			return nil
+		case <-linger:
+			return nil
+		case err := <-sendErr:
+			return err
+		case <-sentAll:
+			// The last reply may have been processed before the last packet
+			// was counted as sent.
+			sentAll = nil
+			if p.complete() {
+				cancel()
+				return nil
+			}
+			if p.group {
+				wait := p.Interval
+				if p.Timeout > wait {
+					wait = p.Timeout
+				}
+				lingerTimer = time.NewTimer(wait)
+				linger = lingerTimer.C
+			}
+		case <-resolveTicks:
+			if !resolving {
+				resolving = true
+				go func() {
+					resolved <- p.reResolve(innerCtx)
+				}()
+			}
+		case <-statsTicks:
+			handler := p.OnStats
+			if handler != nil {
+				handler(p.Statistics())
+			}
+		case err := <-resolved:
+			resolving = false
+			if err != nil {
+				p.printf("Error resolving %s: %s", p.addr, err)
+			}
+		case <-timeouts:
+			timeoutTimer.Reset(p.expire(p.now()))
+			if p.complete() {
+				cancel()
+				return nil
+			}
+		case r := <-recv:
+			if err := p.processPacket(r); err != nil {
+				return err
+			}
+			if p.complete() || p.stopEarly() {
+				cancel()
+				return nil
+			}
+			if p.Flood {
+				select {
+				case flood <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// sendICMPs sends run's echo requests to conn: the first straight away, then one
+// every Interval until Count have been sent, when it closes sentAll, or ctx is
+// done. In flood mode, it's also woken by flood after each reply, to send the
+// next packet as soon as it's due. If sending fails in a way which should end
+// the run, the error is sent to errs.
+func (p *Pinger) sendICMPs(
+	ctx context.Context,
+	conn Conn,
+	flood <-chan struct{},
+	sentAll chan<- struct{},
+	errs chan<- error,
+	wg *sync.WaitGroup,
+) {
+	defer wg.Done()
+
+	// In flood mode the ticker is only used to enforce floodMinInterval and
+	// floodMaxInterval, and packets are otherwise sent as soon as the previous
+	// one is answered.
+	period := p.Interval
+	if p.Flood {
+		period = floodMinInterval
+	}
+	interval := time.NewTicker(period)
+	defer interval.Stop()
+
+	// Only this goroutine counts packets as sent while running, so it can
+	// read PacketsSent without the lock.
+	var lastSend time.Time
+	send := func() bool {
+		if p.Count > 0 && p.PacketsSent >= p.Count {
+			close(sentAll)
+			return false
+		}
+		lastSend = time.Now()
+		if err := p.sendICMP(conn); err != nil {
+			errs <- err
+			return false
+		}
+		if p.Count > 0 && p.PacketsSent >= p.Count {
+			close(sentAll)
+			return false
+		}
+		return true
+	}
+	// Like the unix ping command, flood mode only waits for the reply to the
+	// last packet sent, so an earlier one which was lost doesn't hold up the
+	// rest of the run.
+	floodReady := func() bool {
+		since := time.Since(lastSend)
+		if since >= floodMaxInterval {
+			return true
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		_, waiting := p.outstanding[p.sequence-1]
+		return since >= floodMinInterval && !waiting
+	}
+
+	if !send() {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-interval.C:
+			if p.Flood && !floodReady() {
+				continue
+			}
+		case <-flood:
+			if !floodReady() {
+				continue
+			}
+		}
+		if !send() {
+			return
+		}
+	}
+}
+
+// complete returns whether there was a count, we sent all our packets and
+// every one of them has either been answered or timed out. A group run is
+// never complete.
+func (p *Pinger) complete() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return !p.group && p.Count > 0 && p.PacketsSent >= p.Count && len(p.outstanding) == 0
+}
+
+// stopEarly returns whether StopAfterRecv or StopBelowRtt have been met.
+func (p *Pinger) stopEarly() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.StopAfterRecv > 0 && p.PacketsRecv >= p.StopAfterRecv {
+		return true
+	}
+	return p.StopBelowRtt > 0 && p.summary.count > 0 && p.summary.min < p.StopBelowRtt
+}
+
+// expire counts every outstanding packet which was sent at least Timeout
+// before now as lost, and returns how long it will be until the next one times
+// out.
+func (p *Pinger) expire(now time.Time) time.Duration {
+	next := p.Timeout
+	var seqs []int
+	p.mu.Lock()
+	for seq, sentAt := range p.outstanding {
+		if left := p.Timeout - now.Sub(sentAt); left <= 0 {
+			seqs = append(seqs, seq)
+		} else if left < next {
+			next = left
+		}
+	}
+	p.mu.Unlock()
+	sort.Ints(seqs)
+
+	handler := p.OnTimeout
+	streakHandler := p.OnLossStreak
+	for _, seq := range seqs {
+		p.debugf("Timed out waiting for icmp_seq=%d", seq)
+		p.countLoss(seq, LossTimeout)
+
+		p.mu.Lock()
+		if p.expired == nil {
+			p.expired = make(map[int]bool)
+		}
+		p.expired[seq] = true
+		p.consecutiveLoss++
+		if p.consecutiveLoss > p.maxConsecutiveLoss {
+			p.maxConsecutiveLoss = p.consecutiveLoss
+		}
+		consecutive := p.consecutiveLoss
+		p.mu.Unlock()
+
+		if handler != nil {
+			handler(seq)
+		}
+		p.emit(Event{Type: EventTimeout, Seq: seq})
+		if streakHandler != nil {
+			streakHandler(consecutive)
+		}
+	}
+	return next
+}
+
+// Stop stops the pinger. Run or RunContext will return without an error, and
+// OnFinish will still be called. It is safe to call Stop from any goroutine and
+// to call it more than once. If Stop is called before the pinger has first
+// run, or been run since it was Reset, the next run will stop as soon as it
+// starts, so a run started in another goroutine can't miss it. Once a run has
+// finished, Stop has no effect until the next one starts.
+func (p *Pinger) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cancel == nil && p.ran {
+		return
+	}
+	p.stopped = true
+	if p.cancel != nil {
+		p.cancel()
+	}
+}
+
+// Reset clears pinger's statistics and restarts its sequence numbers from 0,
+// so it can be run again without the results of previous runs. Its target and
+// settings are kept. It returns an error if pinger is currently running.
+func (p *Pinger) Reset() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cancel != nil {
+		return errors.New("Cannot reset a running pinger")
+	}
+
+	p.PacketsSent = 0
+	p.PacketsRecv = 0
+	p.PacketsRecvDuplicates = 0
+	p.PacketsCorrupt = 0
+	if p.statsLimit > 0 {
+		p.rtts = make([]time.Duration, 0, p.statsLimit)
+	} else {
+		p.rtts = nil
+	}
+	p.rttsNext = 0
+	p.summary = rttSummary{}
+	p.outstanding = nil
+	p.losses = nil
+	p.excluded = 0
+	p.consecutiveLoss = 0
+	p.maxConsecutiveLoss = 0
+	p.lastRecvSeq = 0
+	p.recvAny = false
+	p.reordered = 0
+	p.expired = nil
+	p.replyTTLs = nil
+	p.groupSent = nil
+	p.sources = nil
+	p.sourceIndex = nil
+	p.sequence = 0
+	p.ran = false
+	p.stopped = false
+	return nil
+}
+
+// startRun registers cancel as the way for Stop to end the current run, and
+// hook, if it isn't nil, to be passed the run's sends, receives and timeouts
+// after the callbacks for them, so they can be watched without replacing the
+// callbacks.
+func (p *Pinger) startRun(cancel context.CancelFunc, hook func(Event)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.cancel = cancel
+	p.hook = hook
+	if p.stopped {
+		cancel()
+	}
+}
+
+func (p *Pinger) endRun() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.cancel = nil
+	p.hook = nil
+	p.stopped = false
+	p.ran = true
+}
+
+// emit passes e to the current run's hook, if it has one. It mustn't be called
+// with p.mu held.
+func (p *Pinger) emit(e Event) {
+	p.mu.Lock()
+	hook := p.hook
+	p.mu.Unlock()
+
+	if hook != nil {
+		hook(e)
+	}
+}
+
+// stopping returns whether Stop has been called during the current run.
+func (p *Pinger) stopping() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.stopped
+}
+
+func (p *Pinger) dryRun(ctx context.Context) error {
+	count := p.Count
+	if count <= 0 {
+		count = 1
+	}
+
+	for i := 0; i < count; i++ {
+		if err := ctx.Err(); err != nil {
+			if p.stopping() {
+				return nil
+			}
+			return err
+		}
+
+		// Nothing will reply, so the packet isn't tracked
+		bytes, err := p.marshalEcho()
+		if err != nil {
+			return err
+		}
+		p.countSent(len(bytes))
+	}
+
+	return nil
+}
+
+func (p *Pinger) finish() *Statistics {
+	p.mu.Lock()
+	seqs := make([]int, 0, len(p.outstanding))
+	for seq := range p.outstanding {
+		seqs = append(seqs, seq)
+	}
+	p.mu.Unlock()
+	sort.Ints(seqs)
+	for _, seq := range seqs {
+		p.countLoss(seq, LossNoReply)
+	}
+
+	s := p.Statistics()
+	handler := p.OnFinish
+	if handler != nil {
+		handler(s)
+	}
+	return s
+}
+
+// countLoss counts the packet with the given sequence number as lost, unless
+// LossClassifier excludes it.
+func (p *Pinger) countLoss(seq int, reason LossReason) {
+	p.mu.Lock()
+	delete(p.outstanding, seq)
+	p.mu.Unlock()
+
+	classifier := p.LossClassifier
+	excluded := classifier != nil && !classifier(seq, reason)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if excluded {
+		p.excluded++
+		return
+	}
+	if p.losses == nil {
+		p.losses = make(map[LossReason]int)
+	}
+	p.losses[reason]++
+}
+
+// Statistics returns the statistics of the pinger. This can be run while the
+// pinger is running or after it is finished. OnFinish calls this function to
+// get it's finished statistics. It's safe to call from any goroutine, and
+// the returned Statistics is a snapshot which pinger won't modify. Its Rtts
+// is a copy, so sorting or otherwise modifying it doesn't affect pinger.
+func (p *Pinger) Statistics() *Statistics {
+	return p.statistics(0)
+}
+
+// StatisticsWithRtts is like Statistics, but Rtts only holds the most recent n
+// round-trip times, for when the whole run's would be too many. The other
+// statistics are calculated the same as for Statistics. If n is 0 or less,
+// Rtts holds all of them.
+func (p *Pinger) StatisticsWithRtts(n int) *Statistics {
+	return p.statistics(n)
+}
+
+// statistics returns the statistics of the pinger, with at most the last n
+// round-trip times in Rtts if n is greater than 0.
+func (p *Pinger) statistics(n int) *Statistics {
+	p.mu.Lock()
+	s := Statistics{
+		PacketsSent:           p.PacketsSent,
+		PacketsRecv:           p.PacketsRecv,
+		PacketsRecvDuplicates: p.PacketsRecvDuplicates,
+		PacketsCorrupt:        p.PacketsCorrupt,
+		PacketsReordered:      p.reordered,
+		PacketsExcluded:       p.excluded,
+		ConsecutiveLoss:       p.consecutiveLoss,
+		MaxConsecutiveLoss:    p.maxConsecutiveLoss,
+		Losses:                make(map[LossReason]int, len(p.losses)),
+		Rtts:                  p.orderedRtts(),
+		Addr:                  p.addr,
+		IPAddr:                p.ipaddr,
+	}
+	for reason, n := range p.losses {
+		s.Losses[reason] = n
+	}
+	if p.sources != nil {
+		s.Sources = make([]SourceStatistics, len(p.sources))
+		for i, src := range p.sources {
+			s.Sources[i] = src.statistics(s.PacketsSent)
+		}
+	}
+	limited := p.statsLimit > 0
+	summary := p.summary
+	p.mu.Unlock()
+
+	// Nothing sent means nothing lost, as in a dry run. Otherwise, loss is
+	// clamped so it never goes out of range, even if more replies arrive than
+	// were sent.
+	if sent := s.PacketsSent - s.PacketsExcluded; sent > 0 && !p.DryRun {
+		s.PacketLoss = float64(sent-s.PacketsRecv) / float64(sent) * 100
+		s.PacketLoss = math.Max(0, math.Min(100, s.PacketLoss))
+	}
+
+	rtts := s.Rtts
+	if limited {
+		// Rtts is only the most recent, so everything but the percentiles
+		// comes from the whole run's aggregates instead.
+		summary.fill(&s)
+	} else if len(rtts) > 0 {
+		var total time.Duration
+		s.MinRtt = rtts[0]
+		s.MaxRtt = rtts[0]
+		for _, rtt := range rtts {
+			if rtt < s.MinRtt {
+				s.MinRtt = rtt
+			}
+			if rtt > s.MaxRtt {
+				s.MaxRtt = rtt
+			}
+			total += rtt
+		}
+
+		s.TotalRtt = total
+		s.AvgRtt = total / time.Duration(len(rtts))
+		var sumsquares time.Duration
+		for _, rtt := range rtts {
+			sumsquares += (rtt - s.AvgRtt) * (rtt - s.AvgRtt)
+		}
+		s.StdDevRtt = time.Duration(math.Sqrt(
+			float64(sumsquares / time.Duration(len(rtts)))))
+
+		s.Jitter = jitter(rtts)
+	}
+	if len(rtts) > 0 {
+		sorted := sortedRtts(rtts)
+		s.P50Rtt = nearestRank(sorted, 0.50)
+		s.P90Rtt = nearestRank(sorted, 0.90)
+		s.P95Rtt = nearestRank(sorted, 0.95)
+		s.P99Rtt = nearestRank(sorted, 0.99)
+	}
+
+	// Copied again, so the rest of the round-trip times can be freed
+	if n > 0 && len(rtts) > n {
+		s.Rtts = append([]time.Duration(nil), rtts[len(rtts)-n:]...)
+	}
+	return &s
+}
+
+// statistics returns the statistics of the source, given the number of packets
+// sent to its group.
+func (s *source) statistics(sent int) SourceStatistics {
+	var rtts Statistics
+	s.summary.fill(&rtts)
+
+	stats := SourceStatistics{
+		IPAddr:                s.ipaddr,
+		PacketsRecv:           s.recv,
+		PacketsRecvDuplicates: s.dups,
+		MinRtt:                rtts.MinRtt,
+		MaxRtt:                rtts.MaxRtt,
+		AvgRtt:                rtts.AvgRtt,
+		StdDevRtt:             rtts.StdDevRtt,
+	}
+	if sent > 0 {
+		stats.PacketLoss = float64(sent-s.recv) / float64(sent) * 100
+		stats.PacketLoss = math.Max(0, math.Min(100, stats.PacketLoss))
+	}
+	return stats
+}
+
+// SetStatsBufferLimit limits the number of round-trip times pinger keeps to the
+// most recent n, so a long-running pinger's memory use doesn't keep growing.
+// Statistics' Rtts and percentiles are then only of those, but its other
+// round-trip time statistics are still of every reply. If n is 0, which is
+// the default, every round-trip time is kept. It returns an error if n is
+// negative or pinger is currently running.
+func (p *Pinger) SetStatsBufferLimit(n int) error {
+	if n < 0 {
+		return fmt.Errorf("Invalid stats buffer limit: %d", n)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cancel != nil {
+		return errors.New("Cannot change the stats buffer limit of a running pinger")
+	}
+
+	rtts := p.orderedRtts()
+	p.statsLimit = n
+	p.rtts = nil
+	if n > 0 {
+		p.rtts = make([]time.Duration, 0, n)
+	}
+	p.rttsNext = 0
+	p.summary = rttSummary{}
+	for _, rtt := range rtts {
+		p.addRtt(rtt)
+	}
+	return nil
+}
+
+// addRtt records a round-trip time. p.mu must be held.
+func (p *Pinger) addRtt(rtt time.Duration) {
+	p.summary.add(rtt)
+
+	if p.statsLimit <= 0 || len(p.rtts) < p.statsLimit {
+		p.rtts = append(p.rtts, rtt)
+		return
+	}
+	p.rtts[p.rttsNext] = rtt
+	p.rttsNext = (p.rttsNext + 1) % p.statsLimit
+}
+
+// orderedRtts returns a copy of the round-trip times pinger has kept, oldest
+// first. p.mu must be held.
+func (p *Pinger) orderedRtts() []time.Duration {
+	rtts := make([]time.Duration, 0, len(p.rtts))
+	rtts = append(rtts, p.rtts[p.rttsNext:]...)
+	return append(rtts, p.rtts[:p.rttsNext]...)
+}
+
+// rttSummary is a running summary of round-trip times, which doesn't need to
+// keep them.
+type rttSummary struct {
+	count      int
+	sum        time.Duration
+	sumSquares float64
+	min, max   time.Duration
+	last       time.Duration
+	jitterSum  time.Duration
+}
+
+func (r *rttSummary) add(rtt time.Duration) {
+	if r.count == 0 || rtt < r.min {
+		r.min = rtt
+	}
+	if r.count == 0 || rtt > r.max {
+		r.max = rtt
+	}
+	if r.count > 0 {
+		d := rtt - r.last
+		if d < 0 {
+			d = -d
 		}
-		proto = protocolICMP
-	} else {
-		bytes = recv.bytes
+		r.jitterSum += d
+	}
+
+	r.count++
+	r.sum += rtt
+	r.sumSquares += float64(rtt) * float64(rtt)
+	r.last = rtt
+}
+
+// fill sets the round-trip time statistics in s, other than the percentiles,
+// from the summary.
+func (r *rttSummary) fill(s *Statistics) {
+	if r.count == 0 {
+		return
+	}
+
+	s.MinRtt = r.min
+	s.MaxRtt = r.max
+	s.TotalRtt = r.sum
+	s.AvgRtt = r.sum / time.Duration(r.count)
+
+	mean := float64(r.sum) / float64(r.count)
+	variance := r.sumSquares/float64(r.count) - mean*mean
+	s.StdDevRtt = time.Duration(math.Sqrt(math.Max(0, variance)))
+
+	if r.count > 1 {
+		s.Jitter = r.jitterSum / time.Duration(r.count-1)
+	}
+}
+
+// RttCoV returns the coefficient of variation of the round-trip times, which
+// is StdDevRtt divided by AvgRtt. Unlike StdDevRtt, it isn't affected by the
+// overall latency of the path, so it can be used to compare jitter between
+// paths. It returns 0 if AvgRtt is 0.
+func (s *Statistics) RttCoV() float64 {
+	if s.AvgRtt == 0 {
+		return 0
+	}
+	return float64(s.StdDevRtt) / float64(s.AvgRtt)
+}
+
+// Percentile returns the pth percentile round-trip time, where p is between 0
+// and 100, using the nearest-rank method: the result is the smallest of the
+// round-trip times which at least p percent of them are less than or equal to,
+// so it's always one of the measured values. It returns 0 if there are no
+// round-trip times. Rtts is not modified.
+func (s *Statistics) Percentile(p float64) time.Duration {
+	if len(s.Rtts) == 0 {
+		return 0
+	}
+	return nearestRank(sortedRtts(s.Rtts), p/100)
+}
+
+// CDFPoint is a single point on the cumulative distribution of round-trip
+// times: a fraction P of the round-trip times were less than or equal to RTT.
+type CDFPoint struct {
+	RTT time.Duration
+	P   float64
+}
+
+// CDF returns the empirical cumulative distribution of the round-trip times as
+// the given number of evenly spaced points, suitable for plotting. The points
+// are at P = 1/points, 2/points, ..., 1, and each RTT is the nearest-rank
+// quantile at P. It returns nil if there are no round-trip times. Rtts is not
+// modified.
+func (s *Statistics) CDF(points int) []CDFPoint {
+	if points <= 0 || len(s.Rtts) == 0 {
+		return nil
+	}
+
+	sorted := sortedRtts(s.Rtts)
+	cdf := make([]CDFPoint, points)
+	for i := range cdf {
+		p := float64(i+1) / float64(points)
+		cdf[i] = CDFPoint{RTT: nearestRank(sorted, p), P: p}
+	}
+	return cdf
+}
+
+// jitter returns the mean absolute difference between consecutive rtts.
+func jitter(rtts []time.Duration) time.Duration {
+	if len(rtts) < 2 {
+		return 0
+	}
+
+	var total time.Duration
+	for i := 1; i < len(rtts); i++ {
+		d := rtts[i] - rtts[i-1]
+		if d < 0 {
+			d = -d
+		}
+		total += d
+	}
+	return total / time.Duration(len(rtts)-1)
+}
+
+// sortedRtts returns a sorted copy of rtts.
+func sortedRtts(rtts []time.Duration) []time.Duration {
+	sorted := make([]time.Duration, len(rtts))
+	copy(sorted, rtts)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	return sorted
+}
+
+// nearestRank returns the smallest value in sorted which at least a fraction p
+// of the values are less than or equal to. sorted must not be empty.
+func nearestRank(sorted []time.Duration, p float64) time.Duration {
+	// The small offset stops floating point error, such as 0.7*10 coming out
+	// as 7.000000000000001, from pushing the rank up by one.
+	rank := int(math.Ceil(p*float64(len(sorted)) - 1e-9))
+	if rank < 1 {
+		rank = 1
+	} else if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
+
+// recvBufferSize returns how big a buffer is needed to receive replies to
+// pinger's echo requests.
+func (p *Pinger) recvBufferSize() int {
+	if p.readBufferSize > 0 {
+		return p.readBufferSize
+	}
+
+	// Leave room for the ICMP header, and for an IPv4 header with options in
+	// case the socket hands it to us.
+	size := p.size + 8 + 60
+	if size < 512 {
+		return 512
+	}
+	return size
+}
+
+func recvICMP(
+	ctx context.Context,
+	conn Conn,
+	size int,
+	recv chan<- *packet,
+	wg *sync.WaitGroup,
+) {
+	defer wg.Done()
+	for {
+		buf := newRecvBuffer(size)
+		n, ttl, addr, err := readFrom(conn, *buf)
+		if err != nil {
+			recvBuffers.Put(buf)
+
+			// Once the context is done, stopRecv interrupts the read, so
+			// whatever the error is, this is a clean exit.
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			if neterr, ok := err.(*net.OpError); ok && neterr.Timeout() {
+				continue
+			}
+			return
+		}
+
+		select {
+		case recv <- &packet{bytes: *buf, nbytes: n, addr: addr, ttl: ttl, buf: buf}:
+		case <-ctx.Done():
+			recvBuffers.Put(buf)
+			return
+		}
+	}
+}
+
+// readFrom reads a packet from conn, along with its TTL if it's known. Unlike
+// conn.ReadFrom, this reads an icmp.PacketConn through its IPv4 or IPv6 packet
+// conn so the control message carrying the TTL is available. For other Conns
+// the TTL isn't known.
+func readFrom(conn Conn, b []byte) (n, ttl int, src net.Addr, err error) {
+	pc, ok := conn.(*icmp.PacketConn)
+	if !ok {
+		n, src, err = conn.ReadFrom(b)
+		return n, 0, src, err
+	}
+
+	if p4 := pc.IPv4PacketConn(); p4 != nil {
+		var cm *ipv4.ControlMessage
+		n, cm, src, err = p4.ReadFrom(b)
+		if cm != nil {
+			ttl = cm.TTL
+		}
+		return n, ttl, src, err
+	}
+
+	var cm *ipv6.ControlMessage
+	n, cm, src, err = pc.IPv6PacketConn().ReadFrom(b)
+	if cm != nil {
+		ttl = cm.HopLimit
+	}
+	return n, ttl, src, err
+}
+
+// writeDeadliner is implemented by Conns whose writes can be interrupted with a
+// deadline, like *icmp.PacketConn.
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// stopRecv cancels the goroutines reading from and sending to conns and waits
+// for them to exit. Reads block until a packet arrives, so they're interrupted
+// by setting a read deadline which has already passed, and a blocked write is
+// interrupted the same way if the conn supports write deadlines.
+func stopRecv(cancel context.CancelFunc, wg *sync.WaitGroup, conns ...Conn) {
+	cancel()
+	for _, conn := range conns {
+		_ = conn.SetReadDeadline(time.Now())
+		if wd, ok := conn.(writeDeadliner); ok {
+			_ = wd.SetWriteDeadline(time.Now())
+		}
+	}
+	wg.Wait()
+}
+
+func (p *Pinger) processPacket(recv *packet) error {
+	// Parsing copies everything we need out of the packet, so its buffer can
+	// be reused once we're done.
+	defer recv.release()
+
+	bytes := icmpPayload(recv.bytes[:recv.nbytes], p.ipv4)
+	proto := protocolICMP
+	if !p.ipv4 {
 		proto = protocolIPv6ICMP
 	}
 
 	var m *icmp.Message
 	var err error
-	if m, err = icmp.ParseMessage(proto, bytes[:recv.nbytes]); err != nil {
+	if m, err = icmp.ParseMessage(proto, bytes); err != nil {
+		p.debugf("Error parsing ICMP message from %v: %s", recv.addr, err)
 		return fmt.Errorf("Error parsing icmp message")
 	}
 
+	msgHandler := p.OnMessage
+	if msgHandler != nil {
+		msgHandler(m, recv.addr)
+	}
+
+	switch m.Type {
+	case ipv4.ICMPTypeDestinationUnreachable, ipv4.ICMPTypeTimeExceeded,
+		ipv4.ICMPTypeParameterProblem, ipv6.ICMPTypeDestinationUnreachable,
+		ipv6.ICMPTypePacketTooBig, ipv6.ICMPTypeTimeExceeded,
+		ipv6.ICMPTypeParameterProblem:
+		p.processError(m, recv)
+		return nil
+	}
+
 	if m.Type != ipv4.ICMPTypeEchoReply && m.Type != ipv6.ICMPTypeEchoReply {
 		// Not an echo reply, ignore it
+		p.debugf("Ignoring %v from %v", m.Type, recv.addr)
 		return nil
 	}
 
 	outPkt := &Packet{
 		Nbytes: recv.nbytes,
-		IPAddr: p.ipaddr,
+		IPAddr: p.target(),
+		Src:    ipAddrOf(recv.addr),
+		Type:   m.Type,
+		Code:   m.Code,
+		TTL:    recv.ttl,
+
+		Privileged: p.network == "ip",
 	}
 
 	switch pkt := m.Body.(type) {
 	case *icmp.Echo:
-		outPkt.Rtt = time.Since(bytesToTime(pkt.Data[:timeSliceLength]))
-		outPkt.Seq = pkt.Seq
-		p.PacketsRecv++
+		// On Linux in unprivileged mode, the kernel picks the ID and only
+		// hands us replies which match it, so there's nothing to check.
+		if p.checkID() && pkt.ID != p.id {
+			p.debugf("Ignoring echo reply from %v with ID %d", recv.addr, pkt.ID)
+			return nil
+		}
+		outPkt.ID = pkt.ID
+
+		// Only the low 16 bits of the sequence number make it onto the wire.
+		p.mu.Lock()
+		seq := p.fullSeq(pkt.Seq)
+		sentAt, ok := p.outstanding[seq]
+		expired := p.expired[seq]
+		sent := seq >= 0 && seq < p.sequence
+		p.mu.Unlock()
+
+		if p.group {
+			outPkt.Seq = seq
+			p.processGroupReply(outPkt, pkt.Data, recv.addr)
+			return nil
+		}
+
+		// A sequence number we've sent which is no longer outstanding has
+		// already been answered.
+		if expired {
+			// Too late, it's already been counted as lost
+			p.debugf("Ignoring late echo reply from %v: icmp_seq=%d", recv.addr, seq)
+			return nil
+		}
+		duplicate := !ok && sent
+
+		// We'd rather not trust the responder to echo our timestamp
+		// correctly, so we only fall back to it for packets we've lost track
+		// of.
+		if ok {
+			outPkt.Rtt = p.now().Sub(sentAt)
+		} else if len(pkt.Data) >= timeSliceLength {
+			outPkt.Rtt = p.now().Sub(bytesToTime(pkt.Data[:timeSliceLength]))
+		} else if !duplicate {
+			// Not something we sent, or at least nothing we can time
+			p.debugf("Ignoring unknown echo reply from %v: icmp_seq=%d", recv.addr, seq)
+			return nil
+		}
+		outPkt.Seq = seq
+
+		if duplicate {
+			p.debugf("Received duplicate echo reply from %v: icmp_seq=%d", recv.addr, seq)
+
+			p.mu.Lock()
+			p.PacketsRecvDuplicates++
+			firstTTL, known := p.replyTTLs[seq]
+			p.mu.Unlock()
+
+			handler := p.OnDuplicateRecv
+			if handler != nil {
+				handler(outPkt)
+			}
+			p.emit(Event{Type: EventDuplicate, Packet: outPkt})
+
+			if known && outPkt.TTL != 0 && outPkt.TTL != firstTTL {
+				p.debugf("Suspected duplicate address: reply from %v to icmp_seq=%d had TTL %d, the first had %d",
+					recv.addr, seq, outPkt.TTL, firstTTL)
+				if addrHandler := p.OnDuplicateAddr; addrHandler != nil {
+					addrHandler(outPkt, firstTTL)
+				}
+			}
+			return nil
+		}
+
+		if p.VerifyPayload && !p.validPayload(pkt.Data) {
+			p.debugf("Received corrupt echo reply from %v: icmp_seq=%d", recv.addr, seq)
+			p.countLoss(seq, LossCorrupt)
+
+			p.mu.Lock()
+			p.PacketsCorrupt++
+			p.mu.Unlock()
+
+			handler := p.OnCorrupt
+			if handler != nil {
+				handler(outPkt)
+			}
+			return nil
+		}
 	default:
 		// Very bad, not sure how this can happen
 		return fmt.Errorf("Error, invalid ICMP echo reply. Body type: %T, %s",
 			pkt, pkt)
 	}
 
-	p.rtts = append(p.rtts, outPkt.Rtt)
+	p.debugf("Received %d bytes from %v: icmp_seq=%d time=%v",
+		outPkt.Nbytes, recv.addr, outPkt.Seq, outPkt.Rtt)
+
+	p.mu.Lock()
+	delete(p.outstanding, outPkt.Seq)
+	if p.OnDuplicateAddr != nil && outPkt.TTL != 0 {
+		if p.replyTTLs == nil {
+			p.replyTTLs = make(map[int]int)
+		}
+		p.replyTTLs[outPkt.Seq] = outPkt.TTL
+	}
+	if p.recvAny && outPkt.Seq < p.lastRecvSeq {
+		outPkt.OutOfOrder = true
+		p.reordered++
+	} else {
+		p.lastRecvSeq = outPkt.Seq
+		p.recvAny = true
+	}
+	p.PacketsRecv++
+	p.addRtt(outPkt.Rtt)
+	streakEnded := p.consecutiveLoss > 0
+	p.consecutiveLoss = 0
+	p.mu.Unlock()
+
 	handler := p.OnRecv
 	if handler != nil {
 		handler(outPkt)
 	}
+	p.emit(Event{Type: EventRecv, Packet: outPkt})
+	if streakHandler := p.OnLossStreak; streakEnded && streakHandler != nil {
+		streakHandler(0)
+	}
 
 	return nil
 }
 
-func (p *Pinger) sendICMP(conn *icmp.PacketConn) error {
-	var typ icmp.Type
-	if p.ipv4 {
-		typ = ipv4.ICMPTypeEcho
+// processGroupReply handles an echo reply to a broadcast or multicast echo
+// request. Any number of hosts may reply to each one, so only a second reply
+// from the same host is a duplicate. The first reply from any host is what
+// counts the request as received in the pinger's own statistics.
+func (p *Pinger) processGroupReply(outPkt *Packet, data []byte, addr net.Addr) {
+	seq := outPkt.Seq
+	p.mu.Lock()
+	sentAt, ok := p.groupSent[seq]
+	expired := p.expired[seq]
+	p.mu.Unlock()
+	if !ok || expired || outPkt.Src == nil {
+		p.debugf("Ignoring unknown echo reply from %v: icmp_seq=%d", addr, seq)
+		return
+	}
+	outPkt.Rtt = p.now().Sub(sentAt)
+	if p.Timeout > 0 && outPkt.Rtt > p.Timeout {
+		p.debugf("Ignoring late echo reply from %v: icmp_seq=%d", addr, seq)
+		return
+	}
+
+	if p.VerifyPayload && !p.validPayload(data) {
+		// Other hosts may still reply correctly, so this isn't a loss
+		p.debugf("Received corrupt echo reply from %v: icmp_seq=%d", addr, seq)
+
+		p.mu.Lock()
+		p.PacketsCorrupt++
+		p.mu.Unlock()
+
+		handler := p.OnCorrupt
+		if handler != nil {
+			handler(outPkt)
+		}
+		return
+	}
+
+	p.mu.Lock()
+	key := ipKey(outPkt.Src.IP)
+	src := p.sourceIndex[key]
+	if src == nil {
+		src = &source{ipaddr: outPkt.Src, seen: make(map[int]bool)}
+		if p.sourceIndex == nil {
+			p.sourceIndex = make(map[string]*source)
+		}
+		p.sourceIndex[key] = src
+		p.sources = append(p.sources, src)
+	}
+
+	if src.see(seq) {
+		src.dups++
+		p.PacketsRecvDuplicates++
+		p.mu.Unlock()
+
+		p.debugf("Received duplicate echo reply from %v: icmp_seq=%d", addr, seq)
+		handler := p.OnDuplicateRecv
+		if handler != nil {
+			handler(outPkt)
+		}
+		p.emit(Event{Type: EventDuplicate, Packet: outPkt})
+		return
+	}
+	src.recv++
+	src.summary.add(outPkt.Rtt)
+
+	var streakEnded bool
+	if _, first := p.outstanding[seq]; first {
+		delete(p.outstanding, seq)
+
+		if p.recvAny && seq < p.lastRecvSeq {
+			outPkt.OutOfOrder = true
+			p.reordered++
+		} else {
+			p.lastRecvSeq = seq
+			p.recvAny = true
+		}
+		p.PacketsRecv++
+		p.addRtt(outPkt.Rtt)
+		streakEnded = p.consecutiveLoss > 0
+		p.consecutiveLoss = 0
+	}
+	p.mu.Unlock()
+
+	p.debugf("Received %d bytes from %v: icmp_seq=%d time=%v",
+		outPkt.Nbytes, addr, seq, outPkt.Rtt)
+
+	handler := p.OnRecv
+	if handler != nil {
+		handler(outPkt)
+	}
+	p.emit(Event{Type: EventRecv, Packet: outPkt})
+	if streakHandler := p.OnLossStreak; streakEnded && streakHandler != nil {
+		streakHandler(0)
+	}
+}
+
+// processError dispatches an ICMP error message to OnRecvError, if it was sent
+// in response to one of our echo requests.
+func (p *Pinger) processError(m *icmp.Message, recv *packet) {
+	var data []byte
+	switch body := m.Body.(type) {
+	case *icmp.DstUnreach:
+		data = body.Data
+	case *icmp.TimeExceeded:
+		data = body.Data
+	case *icmp.ParamProb:
+		data = body.Data
+	case *icmp.PacketTooBig:
+		data = body.Data
+	}
+
+	// Raw sockets see every ICMP error on the host, so make sure the quoted
+	// packet was headed for our target.
+	target := p.target()
+	dst, echo := parseQuotedEcho(data, p.ipv4)
+	if dst == nil || !dst.Equal(target.IP) {
+		return
+	}
+
+	p.debugf("Received %v (code %d) from %v", m.Type, m.Code, recv.addr)
+
+	seq := -1
+	if echo != nil {
+		if p.checkID() && echo.ID != p.id {
+			// Someone else's echo request
+			return
+		}
+		p.mu.Lock()
+		seq = p.fullSeq(echo.Seq)
+		p.mu.Unlock()
+	}
+
+	handler := p.OnRecvError
+	if handler != nil {
+		handler(&PacketError{
+			Type:   m.Type,
+			Code:   m.Code,
+			Src:    ipAddrOf(recv.addr),
+			IPAddr: target,
+			Seq:    seq,
+		})
+	}
+}
+
+// parseQuotedEcho parses the original datagram quoted in an ICMP error
+// message. It returns the datagram's destination, or nil if the IP header is
+// incomplete, and the echo request it carried, or nil if it wasn't an echo
+// request or was truncated.
+func parseQuotedEcho(b []byte, ipv4 bool) (net.IP, *icmp.Echo) {
+	var dst net.IP
+	var proto int
+	var echoType byte
+	if ipv4 {
+		if len(b) < 20 || b[0]>>4 != 4 {
+			return nil, nil
+		}
+		hdrlen := int(b[0]&0x0f) << 2
+		if hdrlen < 20 || len(b) < hdrlen {
+			return nil, nil
+		}
+		dst = net.IP(b[16:20])
+		proto = int(b[9])
+		echoType = 8
+		b = b[hdrlen:]
 	} else {
-		typ = ipv6.ICMPTypeEchoRequest
+		if len(b) < 40 || b[0]>>4 != 6 {
+			return nil, nil
+		}
+		dst = net.IP(b[24:40])
+		proto = int(b[6])
+		echoType = 128
+		b = b[40:]
+	}
+
+	if proto != protocolICMP && proto != protocolIPv6ICMP {
+		return dst, nil
+	}
+	if len(b) < 8 || b[0] != echoType {
+		return dst, nil
+	}
+
+	// Only the ID and sequence number are needed, and errors may not quote
+	// the whole of the original payload.
+	return dst, &icmp.Echo{
+		ID:  int(b[4])<<8 | int(b[5]),
+		Seq: int(b[6])<<8 | int(b[7]),
+	}
+}
+
+// ipAddrOf returns the IP address of addr, which is expected to be one of the
+// addresses returned by reading from a Conn.
+func ipAddrOf(addr net.Addr) *net.IPAddr {
+	switch addr := addr.(type) {
+	case *net.IPAddr:
+		return addr
+	case *net.UDPAddr:
+		return &net.IPAddr{IP: addr.IP, Zone: addr.Zone}
+	default:
+		return nil
 	}
+}
 
-	var dst net.Addr = p.ipaddr
+// dst returns the address to send echo requests to target at. Unprivileged
+// sockets take a *net.UDPAddr, but have no ports: Linux ignores the port and
+// uses the ID it assigned the socket instead, while darwin sends the echo
+// request as it is. The port is always left as 0, since some platforms
+// reject anything else.
+func (p *Pinger) dst(target *net.IPAddr) net.Addr {
 	if p.network == "udp" {
-		dst = &net.UDPAddr{IP: p.ipaddr.IP, Zone: p.ipaddr.Zone}
+		return &net.UDPAddr{IP: target.IP, Port: 0, Zone: target.Zone}
+	}
+	return target
+}
+
+// checkID returns whether replies need their ID checked against pinger's. Raw
+// sockets see every echo reply on the host, including replies to other
+// pingers, and so do unprivileged sockets on platforms where the kernel
+// doesn't set the ID itself.
+func (p *Pinger) checkID() bool {
+	return p.network != "udp" || !kernelEchoID
+}
+
+func (p *Pinger) sendICMP(conn Conn) error {
+	dst := p.dst(p.target())
+
+	// The packet is tracked before it's written, since the receiving
+	// goroutine may see its reply before WriteTo returns.
+	p.mu.Lock()
+	seq := p.sequence
+	bytes, err := p.marshalEcho()
+	if err == nil {
+		p.track(p.now())
+	}
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	backoff := sendRetryBackoff
+	for retries := 0; ; retries++ {
+		_, err := conn.WriteTo(bytes, dst)
+		if err == nil {
+			break
+		}
+
+		p.mu.Lock()
+		p.untrack(seq)
+		p.mu.Unlock()
+
+		if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+			// stopRecv interrupted the write because the run is over
+			return nil
+		}
+
+		errno, _ := errnoOf(err)
+		switch errno {
+		case syscall.EACCES, syscall.EPERM, syscall.ENETUNREACH, syscall.EINVAL:
+			// These won't go away by themselves, so there's no point carrying
+			// on.
+			return err
+		case syscall.ENOBUFS:
+			if retries < sendMaxRetries {
+				p.debugf("No buffer space sending to %v, retrying in %v", dst, backoff)
+				time.Sleep(backoff)
+				backoff *= 2
+
+				p.mu.Lock()
+				p.track(p.now())
+				p.mu.Unlock()
+				continue
+			}
+		}
+
+		// This packet is lost, but the next one might not be. It isn't
+		// counted as sent.
+		p.printf("Error sending echo request to %v: %s", dst, err)
+		return nil
+	}
+
+	p.debugf("Sent %d bytes to %v: icmp_seq=%d", len(bytes), dst, seq)
+	p.countSent(len(bytes))
+	return nil
+}
+
+// errnoOf returns the errno behind a socket error, if there is one.
+func errnoOf(err error) (syscall.Errno, bool) {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
 	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	errno, ok := err.(syscall.Errno)
+	return errno, ok
+}
 
-	t := timeToBytes(time.Now())
+// marshalEcho builds the echo request for the current sequence number. p.mu
+// must be held while pinger is running.
+func (p *Pinger) marshalEcho() ([]byte, error) {
+	t := timeToBytes(p.now())
 	if p.size-timeSliceLength != 0 {
-		t = append(t, byteSliceOfSize(p.size-timeSliceLength)...)
+		t = append(t, p.padding(p.size-timeSliceLength)...)
 	}
-	bytes, err := (&icmp.Message{
-		Type: typ, Code: 0,
+	return (&icmp.Message{
+		Type: p.echoType(), Code: p.code,
 		Body: &icmp.Echo{
-			ID:   rand.Intn(65535),
-			Seq:  p.sequence,
+			ID:   p.id,
+			Seq:  p.sequence & 0xffff,
 			Data: t,
 		},
 	}).Marshal(nil)
-	if err != nil {
-		return err
+}
+
+// echoType returns the ICMP type of pinger's echo requests.
+func (p *Pinger) echoType() icmp.Type {
+	if p.ipv4 {
+		return ipv4.ICMPTypeEcho
 	}
+	return ipv6.ICMPTypeEchoRequest
+}
 
-	for {
-		if _, err := conn.WriteTo(bytes, dst); err != nil {
-			if neterr, ok := err.(*net.OpError); ok {
-				if neterr.Err == syscall.ENOBUFS {
-					continue
-				}
-			}
+// sent records that the echo request for the current sequence number, nbytes
+// long, was sent at the given time.
+func (p *Pinger) sent(nbytes int, now time.Time) {
+	p.mu.Lock()
+	p.track(now)
+	p.mu.Unlock()
+	p.countSent(nbytes)
+}
+
+// track records that the echo request for the current sequence number is
+// being sent at the given time, so its reply can be matched. p.mu must be
+// held.
+func (p *Pinger) track(now time.Time) {
+	if p.outstanding == nil {
+		p.outstanding = make(map[int]time.Time)
+	}
+	p.outstanding[p.sequence] = now
+
+	if p.group {
+		if p.groupSent == nil {
+			p.groupSent = make(map[int]time.Time)
 		}
-		p.PacketsSent++
-		p.sequence++
-		break
+		p.groupSent[p.sequence] = now
+		delete(p.groupSent, p.sequence-groupHistory)
 	}
-	return nil
+}
+
+// untrack forgets the echo request with the given sequence number, which
+// couldn't be sent. p.mu must be held.
+func (p *Pinger) untrack(seq int) {
+	delete(p.outstanding, seq)
+	delete(p.groupSent, seq)
+}
+
+// countSent counts the echo request for the current sequence number, nbytes
+// long, as sent, and moves on to the next sequence number. That takes the
+// oldest sequence number out of replyWindow, so if it's still outstanding, its
+// reply can't be matched any more and it's counted as lost.
+func (p *Pinger) countSent(nbytes int) {
+	p.mu.Lock()
+	pkt := &Packet{
+		Nbytes: nbytes,
+		IPAddr: p.ipaddr,
+		Seq:    p.sequence,
+		Type:   p.echoType(),
+		Code:   p.code,
+		ID:     p.id,
+	}
+	p.PacketsSent++
+	p.sequence++
+
+	stale := p.sequence - 2 - replyWindow
+	_, lost := p.outstanding[stale]
+	delete(p.expired, stale)
+	delete(p.replyTTLs, stale)
+	p.mu.Unlock()
+
+	if lost {
+		p.debugf("Gave up waiting for icmp_seq=%d", stale)
+		p.countLoss(stale, LossNoReply)
+	}
+
+	handler := p.OnSend
+	if handler != nil {
+		handler(pkt)
+	}
+	p.emit(Event{Type: EventSend, Packet: pkt})
 }
 
 func (p *Pinger) listen(netProto string, source string) (*icmp.PacketConn, error) {
 	conn, err := icmp.ListenPacket(netProto, source)
 	if err != nil {
+		if hint := unprivilegedHint(err); p.network == "udp" && hint != "" {
+			return nil, fmt.Errorf("Error listening for ICMP packets: %s (%s)",
+				err.Error(), hint)
+		}
 		return nil, fmt.Errorf("Error listening for ICMP packets: %s", err.Error())
 	}
 	return conn, nil
 }
 
+// padding returns the n bytes which follow the timestamp in an echo request.
+func (p *Pinger) padding(n int) []byte {
+	if p.pattern == nil {
+		return byteSliceOfSize(n)
+	}
+
+	b := make([]byte, n)
+	for i := 0; i < n; i += len(p.pattern) {
+		copy(b[i:], p.pattern)
+	}
+	return b
+}
+
+// validPayload reports whether data, the data from an echo reply, echoes the
+// payload pinger sends after the timestamp. The timestamp itself differs for
+// every packet, so it isn't checked.
+func (p *Pinger) validPayload(data []byte) bool {
+	if len(data) != p.size {
+		return false
+	}
+	return bytes.Equal(data[timeSliceLength:], p.padding(p.size-timeSliceLength))
+}
+
 func byteSliceOfSize(n int) []byte {
 	b := make([]byte, n)
 	for i := 0; i < len(b); i++ {
@@ -508,12 +3042,32 @@ func byteSliceOfSize(n int) []byte {
 	return b
 }
 
-func ipv4Payload(b []byte) []byte {
-	if len(b) < ipv4.HeaderLen {
+// icmpPayload returns the ICMP message in b, a packet read from an IPv4 socket
+// if ipv4 is set or an IPv6 one otherwise, without any IP header in front of
+// it. Whether there is one depends on the platform and the type of socket:
+// IPv4 raw sockets include it on Linux and darwin but not on some BSDs, and
+// IPv6 and unprivileged sockets generally don't. Rather than guess, this
+// checks for one, which can't be mistaken for an ICMP message since no ICMP
+// type starts with the family's IP version. The header's length fields aren't
+// trusted, since some platforms rewrite them.
+func icmpPayload(b []byte, ipv4 bool) []byte {
+	if ipv4 {
+		if len(b) < 20 || b[0]>>4 != 4 || b[9] != protocolICMP {
+			return b
+		}
+		hdrlen := int(b[0]&0x0f) << 2
+		if hdrlen < 20 || hdrlen > len(b) {
+			return b
+		}
+		return b[hdrlen:]
+	}
+
+	// Extension headers aren't followed, but nothing puts them in front of
+	// an echo reply anyway.
+	if len(b) < 40 || b[0]>>4 != 6 || b[6] != protocolIPv6ICMP {
 		return b
 	}
-	hdrlen := int(b[0]&0x0f) << 2
-	return b[hdrlen:]
+	return b[40:]
 }
 
 func bytesToTime(b []byte) time.Time {
@@ -524,12 +3078,72 @@ func bytesToTime(b []byte) time.Time {
 	return time.Unix(nsec/1000000000, nsec%1000000000)
 }
 
+// replyWindow is how far behind the last sequence number sent fullSeq will
+// match replies.
+const replyWindow = 1 << 15
+
+// fullSeq returns the sequence number pinger sent which has wire, a 16-bit
+// sequence number from a packet, as its low 16 bits. It's whichever is nearest
+// to the last one sent, so it's right as long as replies aren't more than
+// replyWindow packets out. p.mu must be held while pinger is running.
+func (p *Pinger) fullSeq(wire int) int {
+	last := p.sequence - 1
+	seq := last + int(int16(uint16(wire)-uint16(last)))
+	if seq < 0 {
+		// Nothing that far back was sent, so it's as good a guess as any
+		seq += 1 << 16
+	}
+	return seq
+}
+
+// isBroadcast returns whether ip is the limited broadcast address or the
+// broadcast address of one of the host's IPv4 subnets.
+func isBroadcast(ip net.IP) bool {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return false
+	}
+	if ip4.Equal(net.IPv4bcast) {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		network := ipnet.IP.To4()
+		mask := ipnet.Mask
+		if len(mask) == net.IPv6len {
+			mask = mask[12:]
+		}
+		// Point-to-point and host subnets have no broadcast address
+		if ones, bits := mask.Size(); network == nil || bits != 32 || ones > 30 {
+			continue
+		}
+
+		bcast := make(net.IP, net.IPv4len)
+		for i := range bcast {
+			bcast[i] = network[i] | ^mask[i]
+		}
+		if bcast.Equal(ip4) {
+			return true
+		}
+	}
+	return false
+}
+
 func isIPv4(ip net.IP) bool {
 	return len(ip.To4()) == net.IPv4len
 }
 
 func isIPv6(ip net.IP) bool {
-	return len(ip) == net.IPv6len
+	// IPv4 addresses are often stored in 16 bytes too
+	return len(ip) == net.IPv6len && ip.To4() == nil
 }
 
 func timeToBytes(t time.Time) []byte {
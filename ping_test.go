@@ -1,10 +1,26 @@
 package ping
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
 	"net"
+	"os"
+	"runtime"
 	"runtime/debug"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 func TestNewPingerValid(t *testing.T) {
@@ -224,43 +240,3564 @@ func TestStatisticsLossy(t *testing.T) {
 	}
 }
 
-// Test helpers
-func AssertNoError(t *testing.T, err error) {
-	if err != nil {
-		t.Errorf("Expected No Error but got %s, Stack:\n%s",
-			err, string(debug.Stack()))
+func TestOnMessage(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+
+	var types []icmp.Type
+	var addrs []net.Addr
+	p.OnMessage = func(m *icmp.Message, addr net.Addr) {
+		types = append(types, m.Type)
+		addrs = append(addrs, addr)
+	}
+
+	src := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	// An echo reply should be passed through before being processed.
+	reply := marshalMessage(t, &icmp.Message{
+		Type: ipv4.ICMPTypeEchoReply,
+		Body: &icmp.Echo{Seq: 0, Data: timeToBytes(time.Now())},
+	})
+	err = p.processPacket(&packet{bytes: reply, nbytes: len(reply), addr: src})
+	AssertNoError(t, err)
+
+	// Message types Pinger doesn't handle should still be passed through.
+	redirect := marshalMessage(t, &icmp.Message{
+		Type: ipv4.ICMPTypeRedirect,
+		Body: &icmp.DstUnreach{Data: make([]byte, 28)},
+	})
+	err = p.processPacket(&packet{bytes: redirect, nbytes: len(redirect), addr: src})
+	AssertNoError(t, err)
+
+	if len(types) != 2 {
+		t.Fatalf("Expected %v messages, got %v", 2, len(types))
+	}
+	if types[0] != ipv4.ICMPTypeEchoReply {
+		t.Errorf("Expected %v, got %v", ipv4.ICMPTypeEchoReply, types[0])
+	}
+	if types[1] != ipv4.ICMPTypeRedirect {
+		t.Errorf("Expected %v, got %v", ipv4.ICMPTypeRedirect, types[1])
+	}
+	AssertEqualStrings(t, src.String(), addrs[1].String())
+	if p.PacketsRecv != 1 {
+		t.Errorf("Expected %v, got %v", 1, p.PacketsRecv)
 	}
 }
 
-func AssertError(t *testing.T, err error, info string) {
-	if err == nil {
-		t.Errorf("Expected Error but got %s, %s, Stack:\n%s",
-			err, info, string(debug.Stack()))
+func TestSetCode(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	if p.Code() != 0 {
+		t.Errorf("Expected %v, got %v", 0, p.Code())
+	}
+
+	AssertNoError(t, p.SetCode(255))
+	if p.Code() != 255 {
+		t.Errorf("Expected %v, got %v", 255, p.Code())
+	}
+
+	AssertError(t, p.SetCode(-1), "-1")
+	AssertError(t, p.SetCode(256), "256")
+	if p.Code() != 255 {
+		t.Errorf("Expected %v, got %v", 255, p.Code())
+	}
+
+	// The code of the reply should be captured on the packet
+	var code int
+	p.OnRecv = func(pkt *Packet) {
+		code = pkt.Code
+	}
+	reply := marshalMessage(t, &icmp.Message{
+		Type: ipv4.ICMPTypeEchoReply,
+		Code: 3,
+		Body: &icmp.Echo{Data: timeToBytes(time.Now())},
+	})
+	err = p.processPacket(&packet{bytes: reply, nbytes: len(reply)})
+	AssertNoError(t, err)
+	if code != 3 {
+		t.Errorf("Expected %v, got %v", 3, code)
 	}
 }
 
-func AssertEqualStrings(t *testing.T, expected, actual string) {
-	if expected != actual {
-		t.Errorf("Expected %s, got %s, Stack:\n%s",
-			expected, actual, string(debug.Stack()))
+func TestStatisticsRttCoV(t *testing.T) {
+	stats := &Statistics{}
+	if stats.RttCoV() != 0 {
+		t.Errorf("Expected %v, got %v", 0, stats.RttCoV())
+	}
+
+	stats = &Statistics{AvgRtt: 2 * time.Millisecond, StdDevRtt: time.Millisecond}
+	if stats.RttCoV() != 0.5 {
+		t.Errorf("Expected %v, got %v", 0.5, stats.RttCoV())
+	}
+
+	stats = &Statistics{AvgRtt: 200 * time.Millisecond, StdDevRtt: 10 * time.Millisecond}
+	if stats.RttCoV() != 0.05 {
+		t.Errorf("Expected %v, got %v", 0.05, stats.RttCoV())
 	}
 }
 
-func AssertNotEqualStrings(t *testing.T, expected, actual string) {
-	if expected == actual {
-		t.Errorf("Expected %s, got %s, Stack:\n%s",
-			expected, actual, string(debug.Stack()))
+func TestDryRun(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.DryRun = true
+	p.Count = 3
+	p.Interval = time.Hour
+
+	var seqs []int
+	p.OnSend = func(pkt *Packet) {
+		seqs = append(seqs, pkt.Seq)
+		if pkt.Nbytes != timeSliceLength+8 {
+			t.Errorf("Expected %v, got %v", timeSliceLength+8, pkt.Nbytes)
+		}
+	}
+	finished := false
+	p.OnFinish = func(stats *Statistics) {
+		finished = true
+	}
+	classified := 0
+	p.LossClassifier = func(int, LossReason) bool {
+		classified++
+		return true
+	}
+
+	stats, err := p.Run()
+	AssertNoError(t, err)
+	AssertTrue(t, finished)
+	if p.PacketsSent != 3 {
+		t.Errorf("Expected %v, got %v", 3, p.PacketsSent)
+	}
+
+	// Nothing was really sent, so nothing was lost
+	if stats.PacketLoss != 0 || len(stats.Losses) != 0 || classified != 0 {
+		t.Errorf("Expected no loss, got %v%%, %v and %v classified",
+			stats.PacketLoss, stats.Losses, classified)
+	}
+	if len(seqs) != 3 || seqs[0] != 0 || seqs[2] != 2 {
+		t.Errorf("Expected sequences [0 1 2], got %v", seqs)
 	}
 }
 
-func AssertTrue(t *testing.T, b bool) {
-	if !b {
-		t.Errorf("Expected True, got False, Stack:\n%s", string(debug.Stack()))
+func TestStatisticsCDF(t *testing.T) {
+	stats := &Statistics{}
+	if cdf := stats.CDF(4); cdf != nil {
+		t.Errorf("Expected nil, got %v", cdf)
+	}
+
+	stats.Rtts = []time.Duration{
+		time.Duration(40),
+		time.Duration(10),
+		time.Duration(30),
+		time.Duration(20),
+	}
+	if cdf := stats.CDF(0); cdf != nil {
+		t.Errorf("Expected nil, got %v", cdf)
+	}
+
+	expected := []CDFPoint{
+		{RTT: time.Duration(10), P: 0.25},
+		{RTT: time.Duration(20), P: 0.5},
+		{RTT: time.Duration(30), P: 0.75},
+		{RTT: time.Duration(40), P: 1},
+	}
+	cdf := stats.CDF(4)
+	if len(cdf) != len(expected) {
+		t.Fatalf("Expected %v points, got %v", len(expected), len(cdf))
+	}
+	for i := range expected {
+		if cdf[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected[i], cdf[i])
+		}
+	}
+
+	// More points than samples should repeat samples rather than fail
+	cdf = stats.CDF(8)
+	if cdf[0].RTT != time.Duration(10) || cdf[1].RTT != time.Duration(10) {
+		t.Errorf("Expected %v, got %v", time.Duration(10), cdf[:2])
+	}
+	if cdf[7].RTT != time.Duration(40) {
+		t.Errorf("Expected %v, got %v", time.Duration(40), cdf[7].RTT)
+	}
+
+	// The stored round-trip times shouldn't be sorted in place
+	if stats.Rtts[0] != time.Duration(40) {
+		t.Errorf("Expected %v, got %v", time.Duration(40), stats.Rtts[0])
 	}
 }
 
-func AssertFalse(t *testing.T, b bool) {
-	if b {
-		t.Errorf("Expected False, got True, Stack:\n%s", string(debug.Stack()))
+func TestFallbackTimeout(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.Interval = 100 * time.Millisecond
+
+	// No count means no fallback timeout
+	_, ok := p.fallbackTimeout()
+	AssertFalse(t, ok)
+
+	p.Count = 3
+	timeout, ok := p.fallbackTimeout()
+	AssertTrue(t, ok)
+	if timeout != 500*time.Millisecond {
+		t.Errorf("Expected %v, got %v", 500*time.Millisecond, timeout)
+	}
+
+	// A long expected RTT should extend the timeout
+	p.ExpectedRtt = 600 * time.Millisecond
+	timeout, ok = p.fallbackTimeout()
+	AssertTrue(t, ok)
+	if timeout != 1100*time.Millisecond {
+		t.Errorf("Expected %v, got %v", 1100*time.Millisecond, timeout)
+	}
+
+	// As should a longer per-reply timeout
+	p.Timeout = 800 * time.Millisecond
+	timeout, ok = p.fallbackTimeout()
+	AssertTrue(t, ok)
+	if timeout != 1300*time.Millisecond {
+		t.Errorf("Expected %v, got %v", 1300*time.Millisecond, timeout)
+	}
+	p.Timeout = 0
+
+	// As should a deadline
+	p.Deadline = time.Second
+	_, ok = p.fallbackTimeout()
+	AssertFalse(t, ok)
+
+	p.Deadline = 0
+	p.NoFallbackTimeout = true
+	_, ok = p.fallbackTimeout()
+	AssertFalse(t, ok)
+	p.NoFallbackTimeout = false
+
+	// A timeout too long to represent means no fallback timeout, rather than
+	// one which has overflowed
+	p.Count = math.MaxInt32
+	p.Interval = time.Hour
+	_, ok = p.fallbackTimeout()
+	AssertFalse(t, ok)
+
+	p.Interval = time.Duration(math.MaxInt64) / 4
+	p.Count = 3
+	_, ok = p.fallbackTimeout()
+	AssertFalse(t, ok)
+}
+
+func TestFallbackTimeoutOverflow(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.SetConn(newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		return []*icmp.Message{echoReply(req)}
+	}))
+
+	// Interval*(Count+2) overflows a time.Duration, which used to leave a
+	// negative fallback timeout which ended the run straight away.
+	p.Count = math.MaxInt32
+	p.Interval = time.Hour
+	p.OnRecv = func(pkt *Packet) {
+		p.Stop()
+	}
+
+	stats, err := p.Run()
+	AssertNoError(t, err)
+	if stats.PacketsRecv != 1 {
+		t.Errorf("Expected 1 packet received, got %v", stats.PacketsRecv)
+	}
+}
+
+func TestLossClassifier(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+
+	var classified []int
+	p.LossClassifier = func(seq int, reason LossReason) bool {
+		classified = append(classified, seq)
+		if reason != LossNoReply {
+			t.Errorf("Expected %v, got %v", LossNoReply, reason)
+		}
+		// Pretend the last packet was rate limited
+		return seq != 3
+	}
+
+	for seq := 0; seq < 4; seq++ {
+		p.sent(16, time.Now())
+	}
+	for _, seq := range []int{0, 2} {
+		reply := marshalMessage(t, &icmp.Message{
+			Type: ipv4.ICMPTypeEchoReply,
+			Body: &icmp.Echo{Seq: seq, Data: timeToBytes(time.Now())},
+		})
+		AssertNoError(t, p.processPacket(&packet{bytes: reply, nbytes: len(reply)}))
+	}
+
+	// Nothing should be classified until the pinger finishes
+	stats := p.Statistics()
+	if stats.PacketLoss != 50 {
+		t.Errorf("Expected %v, got %v", 50, stats.PacketLoss)
+	}
+
+	var final *Statistics
+	p.OnFinish = func(s *Statistics) {
+		final = s
+	}
+	p.finish()
+
+	if len(classified) != 2 || classified[0] != 1 || classified[1] != 3 {
+		t.Errorf("Expected sequences [1 3] to be classified, got %v", classified)
+	}
+	if final.PacketsExcluded != 1 {
+		t.Errorf("Expected %v, got %v", 1, final.PacketsExcluded)
+	}
+	if final.Losses[LossNoReply] != 1 {
+		t.Errorf("Expected %v, got %v", 1, final.Losses[LossNoReply])
+	}
+	if math.Abs(final.PacketLoss-100.0/3) > 1e-9 {
+		t.Errorf("Expected %v, got %v", 100.0/3, final.PacketLoss)
+	}
+}
+
+func TestEchoIDMatching(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	other, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	if p.id == other.id {
+		t.Errorf("Expected different IDs, both got %v", p.id)
+	}
+
+	reply := func(id int) *packet {
+		b := marshalMessage(t, &icmp.Message{
+			Type: ipv4.ICMPTypeEchoReply,
+			Body: &icmp.Echo{ID: id, Data: timeToBytes(time.Now())},
+		})
+		return &packet{bytes: b, nbytes: len(b)}
+	}
+
+	// Privileged raw sockets see every reply, so foreign IDs must be ignored
+	p.SetPrivileged(true)
+	AssertNoError(t, p.processPacket(reply(other.id)))
+	if p.PacketsRecv != 0 {
+		t.Errorf("Expected %v, got %v", 0, p.PacketsRecv)
+	}
+	AssertNoError(t, p.processPacket(reply(p.id)))
+	if p.PacketsRecv != 1 {
+		t.Errorf("Expected %v, got %v", 1, p.PacketsRecv)
+	}
+
+	// In unprivileged mode the kernel rewrites the ID, so it isn't checked
+	p.SetPrivileged(false)
+	AssertNoError(t, p.processPacket(reply(other.id)))
+	if p.PacketsRecv != 2 {
+		t.Errorf("Expected %v, got %v", 2, p.PacketsRecv)
+	}
+}
+
+func TestConcurrentPingers(t *testing.T) {
+	SkipUnlessPrivileged(t)
+
+	var pingers [2]*Pinger
+	var errs [2]error
+	var wg sync.WaitGroup
+	for i := range pingers {
+		p, err := NewPinger("127.0.0.1")
+		AssertNoError(t, err)
+		p.SetPrivileged(true)
+		p.Count = 5
+		p.Interval = 50 * time.Millisecond
+		pingers[i] = p
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = pingers[i].Run()
+		}(i)
+	}
+	wg.Wait()
+
+	for i, p := range pingers {
+		AssertNoError(t, errs[i])
+		stats := p.Statistics()
+		if stats.PacketsSent != 5 {
+			t.Errorf("Expected %v, got %v", 5, stats.PacketsSent)
+		}
+		if stats.PacketsRecv != 5 {
+			t.Errorf("Expected %v, got %v", 5, stats.PacketsRecv)
+		}
+	}
+}
+
+func TestRttFromSendTime(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+
+	var rtts []time.Duration
+	p.OnRecv = func(pkt *Packet) {
+		rtts = append(rtts, pkt.Rtt)
+	}
+
+	p.sent(16, time.Now().Add(-time.Second))
+
+	// A reply with its payload stripped should still be timed from when the
+	// request was sent
+	stripped := marshalMessage(t, &icmp.Message{
+		Type: ipv4.ICMPTypeEchoReply,
+		Body: &icmp.Echo{Seq: 0},
+	})
+	AssertNoError(t, p.processPacket(&packet{bytes: stripped, nbytes: len(stripped)}))
+
+	// As should a reply with a bogus timestamp
+	p.sent(16, time.Now().Add(-time.Second))
+	bogus := marshalMessage(t, &icmp.Message{
+		Type: ipv4.ICMPTypeEchoReply,
+		Body: &icmp.Echo{Seq: 1, Data: timeToBytes(time.Unix(0, 0))},
+	})
+	AssertNoError(t, p.processPacket(&packet{bytes: bogus, nbytes: len(bogus)}))
+
+	if len(rtts) != 2 {
+		t.Fatalf("Expected %v replies, got %v", 2, len(rtts))
+	}
+	for _, rtt := range rtts {
+		if rtt < time.Second || rtt > 2*time.Second {
+			t.Errorf("Expected an RTT of about 1s, got %v", rtt)
+		}
+	}
+
+	// Replies we didn't send and can't time should be ignored
+	unsent := marshalMessage(t, &icmp.Message{
+		Type: ipv4.ICMPTypeEchoReply,
+		Body: &icmp.Echo{Seq: 2},
+	})
+	AssertNoError(t, p.processPacket(&packet{bytes: unsent, nbytes: len(unsent)}))
+	if p.PacketsRecv != 2 {
+		t.Errorf("Expected %v, got %v", 2, p.PacketsRecv)
+	}
+}
+
+func TestDuplicateRecv(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+
+	recv := 0
+	p.OnRecv = func(pkt *Packet) {
+		recv++
+	}
+	var dups []*Packet
+	p.OnDuplicateRecv = func(pkt *Packet) {
+		dups = append(dups, pkt)
+	}
+
+	p.sent(16, time.Now())
+	reply := marshalMessage(t, &icmp.Message{
+		Type: ipv4.ICMPTypeEchoReply,
+		Body: &icmp.Echo{Seq: 0, Data: timeToBytes(time.Now())},
+	})
+	AssertNoError(t, p.processPacket(&packet{bytes: reply, nbytes: len(reply)}))
+	AssertNoError(t, p.processPacket(&packet{bytes: reply, nbytes: len(reply)}))
+
+	if recv != 1 {
+		t.Errorf("Expected OnRecv to be called %v times, got %v", 1, recv)
+	}
+	if len(dups) != 1 {
+		t.Fatalf("Expected OnDuplicateRecv to be called %v times, got %v", 1, len(dups))
+	}
+	if dups[0].Seq != 0 {
+		t.Errorf("Expected seq %v, got %v", 0, dups[0].Seq)
+	}
+
+	stats := p.Statistics()
+	if stats.PacketsRecv != 1 {
+		t.Errorf("Expected %v, got %v", 1, stats.PacketsRecv)
+	}
+	if stats.PacketsRecvDuplicates != 1 {
+		t.Errorf("Expected %v, got %v", 1, stats.PacketsRecvDuplicates)
+	}
+	if len(stats.Rtts) != 1 {
+		t.Errorf("Expected %v rtts, got %v", 1, len(stats.Rtts))
+	}
+	if stats.PacketLoss != 0 {
+		t.Errorf("Expected %v, got %v", 0.0, stats.PacketLoss)
+	}
+}
+
+func TestDuplicateAddr(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+
+	dups := 0
+	p.OnDuplicateRecv = func(pkt *Packet) {
+		dups++
+	}
+	var suspects []*Packet
+	var firstTTLs []int
+	p.OnDuplicateAddr = func(pkt *Packet, firstTTL int) {
+		suspects = append(suspects, pkt)
+		firstTTLs = append(firstTTLs, firstTTL)
+	}
+
+	recv := func(seq, ttl int) {
+		reply := marshalMessage(t, &icmp.Message{
+			Type: ipv4.ICMPTypeEchoReply,
+			Body: &icmp.Echo{Seq: seq, Data: timeToBytes(time.Now())},
+		})
+		AssertNoError(t, p.processPacket(&packet{bytes: reply, nbytes: len(reply), ttl: ttl}))
+	}
+	for seq := 0; seq < 3; seq++ {
+		p.sent(16, time.Now())
+	}
+
+	// A plain duplicate from the same responder isn't suspicious
+	recv(0, 64)
+	recv(0, 64)
+
+	// Two responders with different TTLs answering each request is
+	recv(1, 64)
+	recv(1, 61)
+
+	// Without the TTL, there's nothing to go on
+	recv(2, 0)
+	recv(2, 61)
+
+	if dups != 3 {
+		t.Errorf("Expected OnDuplicateRecv to be called %v times, got %v", 3, dups)
+	}
+	if len(suspects) != 1 {
+		t.Fatalf("Expected OnDuplicateAddr to be called %v times, got %v", 1, len(suspects))
+	}
+	if suspects[0].Seq != 1 || suspects[0].TTL != 61 || firstTTLs[0] != 64 {
+		t.Errorf("Expected icmp_seq=1 with TTL 61 after 64, got icmp_seq=%d with TTL %d after %d",
+			suspects[0].Seq, suspects[0].TTL, firstTTLs[0])
+	}
+
+	// The TTLs are forgotten on reset, and only kept within the window of
+	// replies which can still be matched
+	AssertNoError(t, p.Reset())
+	if p.replyTTLs != nil {
+		t.Errorf("Expected reply TTLs to be cleared, got %v", p.replyTTLs)
+	}
+	for seq := 0; seq < 2*replyWindow; seq++ {
+		p.sent(16, time.Now())
+		recv(seq&0xffff, 64)
+	}
+	if len(p.replyTTLs) > replyWindow+1 {
+		t.Errorf("Expected at most %v reply TTLs, got %v", replyWindow+1, len(p.replyTTLs))
+	}
+}
+
+func TestOutOfOrder(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+
+	var recv []*Packet
+	p.OnRecv = func(pkt *Packet) {
+		recv = append(recv, pkt)
+	}
+
+	for seq := 0; seq < 4; seq++ {
+		p.sent(16, time.Now())
+	}
+	for _, seq := range []int{3, 1, 2} {
+		reply := marshalMessage(t, &icmp.Message{
+			Type: ipv4.ICMPTypeEchoReply,
+			Body: &icmp.Echo{Seq: seq, Data: timeToBytes(time.Now())},
+		})
+		AssertNoError(t, p.processPacket(&packet{bytes: reply, nbytes: len(reply)}))
+	}
+
+	expected := []bool{false, true, true}
+	if len(recv) != len(expected) {
+		t.Fatalf("Expected %v replies, got %v", len(expected), len(recv))
+	}
+	for i, pkt := range recv {
+		if pkt.OutOfOrder != expected[i] {
+			t.Errorf("icmp_seq=%d: expected OutOfOrder to be %v", pkt.Seq, expected[i])
+		}
+	}
+	if stats := p.Statistics(); stats.PacketsReordered != 2 {
+		t.Errorf("Expected %v, got %v", 2, stats.PacketsReordered)
+	}
+}
+
+func TestVerifyPayload(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.VerifyPayload = true
+	AssertNoError(t, p.SetPayloadSize(24))
+	p.SetPayloadPattern([]byte{0xde, 0xad})
+
+	recv := 0
+	p.OnRecv = func(pkt *Packet) {
+		recv++
+	}
+	var corrupt []*Packet
+	p.OnCorrupt = func(pkt *Packet) {
+		corrupt = append(corrupt, pkt)
+	}
+
+	var replies [][]byte
+	for seq := 0; seq < 3; seq++ {
+		b, err := p.marshalEcho()
+		AssertNoError(t, err)
+		p.sent(len(b), time.Now())
+
+		req, err := icmp.ParseMessage(protocolICMP, b)
+		AssertNoError(t, err)
+		reply := echoReply(req)
+		data := reply.Body.(*icmp.Echo).Data
+		switch seq {
+		case 1:
+			// Flip a byte of the pattern
+			data[len(data)-1] ^= 0xff
+		case 2:
+			// The timestamp isn't checked
+			data[0] ^= 0xff
+		}
+		replies = append(replies, marshalMessage(t, reply))
+	}
+	for _, reply := range replies {
+		AssertNoError(t, p.processPacket(&packet{bytes: reply, nbytes: len(reply)}))
+	}
+
+	if recv != 2 {
+		t.Errorf("Expected OnRecv to be called %v times, got %v", 2, recv)
+	}
+	if len(corrupt) != 1 {
+		t.Fatalf("Expected OnCorrupt to be called %v times, got %v", 1, len(corrupt))
+	}
+	if corrupt[0].Seq != 1 {
+		t.Errorf("Expected seq %v, got %v", 1, corrupt[0].Seq)
+	}
+
+	stats := p.Statistics()
+	if stats.PacketsRecv != 2 {
+		t.Errorf("Expected %v, got %v", 2, stats.PacketsRecv)
+	}
+	if stats.PacketsCorrupt != 1 {
+		t.Errorf("Expected %v, got %v", 1, stats.PacketsCorrupt)
+	}
+	if stats.Losses[LossCorrupt] != 1 {
+		t.Errorf("Expected %v, got %v", 1, stats.Losses[LossCorrupt])
+	}
+	if len(stats.Rtts) != 2 {
+		t.Errorf("Expected %v rtts, got %v", 2, len(stats.Rtts))
+	}
+
+	// Without VerifyPayload, a corrupt reply is received as normal
+	AssertNoError(t, p.Reset())
+	p.VerifyPayload = false
+	b, err := p.marshalEcho()
+	AssertNoError(t, err)
+	p.sent(len(b), time.Now())
+	req, err := icmp.ParseMessage(protocolICMP, b)
+	AssertNoError(t, err)
+	reply := echoReply(req)
+	reply.Body.(*icmp.Echo).Data[timeSliceLength] ^= 0xff
+	b = marshalMessage(t, reply)
+	AssertNoError(t, p.processPacket(&packet{bytes: b, nbytes: len(b)}))
+	if stats := p.Statistics(); stats.PacketsRecv != 1 || stats.PacketsCorrupt != 0 {
+		t.Errorf("Expected 1 received and 0 corrupt, got %v and %v",
+			stats.PacketsRecv, stats.PacketsCorrupt)
+	}
+}
+
+func TestStop(t *testing.T) {
+	SkipUnlessPrivileged(t)
+
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.Interval = 100 * time.Millisecond
+
+	finished := false
+	p.OnFinish = func(stats *Statistics) {
+		finished = true
+	}
+
+	time.AfterFunc(2*time.Second, p.Stop)
+	start := time.Now()
+	_, err = p.Run()
+	AssertNoError(t, err)
+	elapsed := time.Since(start)
+
+	AssertTrue(t, finished)
+	if elapsed < 2*time.Second || elapsed > 3*time.Second {
+		t.Errorf("Expected to stop after about 2s, took %v", elapsed)
+	}
+	if p.PacketsSent < 15 {
+		t.Errorf("Expected at least %v packets sent, got %v", 15, p.PacketsSent)
+	}
+
+	// Stopping again after the run should be harmless
+	p.Stop()
+	p.Stop()
+}
+
+func TestStopBeforeRun(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.DryRun = true
+	p.Count = 3
+
+	finished := false
+	p.OnFinish = func(stats *Statistics) {
+		finished = true
+	}
+
+	p.Stop()
+	_, err = p.Run()
+	AssertNoError(t, err)
+	AssertTrue(t, finished)
+	if p.PacketsSent != 0 {
+		t.Errorf("Expected %v, got %v", 0, p.PacketsSent)
+	}
+
+	// The stop should only apply to a single run
+	_, err = p.Run()
+	AssertNoError(t, err)
+	if p.PacketsSent != 3 {
+		t.Errorf("Expected %v, got %v", 3, p.PacketsSent)
+	}
+
+	// A stop which arrives after a run has finished is too late for it, and
+	// shouldn't carry over to the next one
+	p.Stop()
+	_, err = p.Run()
+	AssertNoError(t, err)
+	if p.PacketsSent != 6 {
+		t.Errorf("Expected %v, got %v", 6, p.PacketsSent)
+	}
+
+	// Once reset, it's as good as new
+	AssertNoError(t, p.Reset())
+	p.Stop()
+	_, err = p.Run()
+	AssertNoError(t, err)
+	if p.PacketsSent != 0 {
+		t.Errorf("Expected %v, got %v", 0, p.PacketsSent)
+	}
+}
+
+func TestRunReturnsStatistics(t *testing.T) {
+	SkipUnlessPrivileged(t)
+
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.Count = 3
+	p.Interval = 50 * time.Millisecond
+
+	var finished *Statistics
+	p.OnFinish = func(stats *Statistics) {
+		finished = stats
+	}
+
+	stats, err := p.Run()
+	AssertNoError(t, err)
+	AssertTrue(t, stats == finished)
+	if stats.PacketsSent != 3 {
+		t.Errorf("Expected %v, got %v", 3, stats.PacketsSent)
+	}
+	if stats.PacketsRecv != 3 {
+		t.Errorf("Expected %v, got %v", 3, stats.PacketsRecv)
+	}
+}
+
+func TestRunContextTimeoutReturnsStatistics(t *testing.T) {
+	SkipUnlessPrivileged(t)
+
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.Count = 100
+	p.Interval = 50 * time.Millisecond
+
+	var finished *Statistics
+	p.OnFinish = func(stats *Statistics) {
+		finished = stats
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	stats, err := p.RunContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if stats == nil {
+		t.Fatal("Expected statistics, got nil")
+	}
+	AssertTrue(t, stats == finished)
+	if stats.PacketsSent == 0 || stats.PacketsSent >= 100 {
+		t.Errorf("Expected a partial run, got %v packets sent", stats.PacketsSent)
+	}
+}
+
+func TestStopLatency(t *testing.T) {
+	SkipUnlessPrivileged(t)
+
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.Interval = time.Hour
+
+	done := make(chan time.Time)
+	go func() {
+		_, err := p.Run()
+		AssertNoError(t, err)
+		done <- time.Now()
+	}()
+
+	// Give the pinger time to go idle, blocked waiting for a reply which will
+	// never come.
+	time.Sleep(200 * time.Millisecond)
+	stopped := time.Now()
+	p.Stop()
+
+	// The receive loop doesn't poll, so stopping should be near instant.
+	if latency := (<-done).Sub(stopped); latency > 50*time.Millisecond {
+		t.Errorf("Expected to stop within 50ms, took %v", latency)
+	}
+}
+
+func TestSetPayloadSize(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	if p.PayloadSize() != timeSliceLength {
+		t.Errorf("Expected %v, got %v", timeSliceLength, p.PayloadSize())
+	}
+
+	// There has to be room for the timestamp
+	AssertError(t, p.SetPayloadSize(timeSliceLength-1), "too small")
+	if p.PayloadSize() != timeSliceLength {
+		t.Errorf("Expected %v, got %v", timeSliceLength, p.PayloadSize())
+	}
+
+	AssertNoError(t, p.SetPayloadSize(1000))
+	if p.PayloadSize() != 1000 {
+		t.Errorf("Expected %v, got %v", 1000, p.PayloadSize())
+	}
+}
+
+func TestLargePayload(t *testing.T) {
+	SkipUnlessPrivileged(t)
+
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.Count = 1
+	AssertNoError(t, p.SetPayloadSize(1000))
+
+	var nbytes int
+	p.OnRecv = func(pkt *Packet) {
+		nbytes = pkt.Nbytes
+	}
+
+	_, err = p.Run()
+	AssertNoError(t, err)
+
+	// The reply should carry the whole payload plus the ICMP header
+	if nbytes != 1008 {
+		t.Errorf("Expected %v, got %v", 1008, nbytes)
+	}
+}
+
+func TestSetReadBufferSize(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.Count = 1
+	AssertError(t, p.SetReadBufferSize(-1), "-1")
+
+	// The buffer grows with the payload by default
+	AssertNoError(t, p.SetPayloadSize(1400))
+	if p.ReadBufferSize() < 1408 {
+		t.Errorf("Expected room for at least %v bytes, got %v", 1408, p.ReadBufferSize())
+	}
+
+	var recv *Packet
+	p.OnRecv = func(pkt *Packet) {
+		recv = pkt
+	}
+	p.SetConn(newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		return []*icmp.Message{echoReply(req)}
+	}))
+
+	start := time.Now()
+	_, err = p.Run()
+	AssertNoError(t, err)
+	if recv == nil {
+		t.Fatal("Expected a reply")
+	}
+	if recv.Nbytes != 1408 {
+		t.Errorf("Expected %v, got %v", 1408, recv.Nbytes)
+	}
+	if recv.Rtt <= 0 || recv.Rtt > time.Since(start) {
+		t.Errorf("Expected an RTT within the run, got %v", recv.Rtt)
+	}
+
+	AssertNoError(t, p.SetReadBufferSize(4096))
+	if p.ReadBufferSize() != 4096 {
+		t.Errorf("Expected %v, got %v", 4096, p.ReadBufferSize())
+	}
+	AssertNoError(t, p.SetReadBufferSize(0))
+	if p.ReadBufferSize() < 1408 {
+		t.Errorf("Expected room for at least %v bytes, got %v", 1408, p.ReadBufferSize())
+	}
+}
+
+func TestSetTTL(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	if p.TTL() != 0 {
+		t.Errorf("Expected %v, got %v", 0, p.TTL())
+	}
+
+	AssertError(t, p.SetTTL(0), "0")
+	AssertError(t, p.SetTTL(256), "256")
+	AssertNoError(t, p.SetTTL(32))
+	if p.TTL() != 32 {
+		t.Errorf("Expected %v, got %v", 32, p.TTL())
+	}
+}
+
+func TestRecvTTL(t *testing.T) {
+	SkipUnlessPrivileged(t)
+
+	for _, addr := range []string{"127.0.0.1", "::1"} {
+		p, err := NewPinger(addr)
+		AssertNoError(t, err)
+		p.SetPrivileged(true)
+		p.Count = 1
+		AssertNoError(t, p.SetTTL(1))
+
+		ttl := -1
+		p.OnRecv = func(pkt *Packet) {
+			ttl = pkt.TTL
+		}
+
+		// A TTL of 1 is still enough to reach the loopback interface
+		stats, err := p.Run()
+		AssertNoError(t, err)
+		if stats.PacketsRecv != 1 {
+			t.Fatalf("Expected %v, got %v", 1, stats.PacketsRecv)
+		}
+
+		// The reply's TTL is chosen by the responder, so we can only check
+		// it's sane.
+		if ttl < 1 || ttl > 255 {
+			t.Errorf("Expected a TTL between 1 and 255 from %s, got %v", addr, ttl)
+		}
+	}
+}
+
+func TestOnRecvError(t *testing.T) {
+	p, err := NewPinger("192.0.2.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+
+	var errs []*PacketError
+	p.OnRecvError = func(e *PacketError) {
+		errs = append(errs, e)
+	}
+
+	router := &net.IPAddr{IP: net.IPv4(10, 0, 0, 1)}
+	timeExceeded := func(dst net.IP, quoted []byte) *packet {
+		h := &ipv4.Header{
+			Version:  4,
+			Len:      ipv4.HeaderLen,
+			TotalLen: ipv4.HeaderLen + len(quoted),
+			TTL:      1,
+			Protocol: protocolICMP,
+			Src:      net.IPv4(10, 0, 0, 2),
+			Dst:      dst,
+		}
+		hb, err := h.Marshal()
+		AssertNoError(t, err)
+		b := marshalMessage(t, &icmp.Message{
+			Type: ipv4.ICMPTypeTimeExceeded,
+			Body: &icmp.TimeExceeded{Data: append(hb, quoted...)},
+		})
+		return &packet{bytes: b, nbytes: len(b), addr: router}
+	}
+	request := func(id, seq int) []byte {
+		return marshalMessage(t, &icmp.Message{
+			Type: ipv4.ICMPTypeEcho,
+			Body: &icmp.Echo{ID: id, Seq: seq, Data: timeToBytes(time.Now())},
+		})
+	}
+
+	AssertNoError(t, p.processPacket(timeExceeded(p.ipaddr.IP, request(p.id, 7))))
+
+	// Errors about other hosts or other pingers' requests should be ignored
+	AssertNoError(t, p.processPacket(timeExceeded(net.IPv4(192, 0, 2, 2), request(p.id, 8))))
+	AssertNoError(t, p.processPacket(timeExceeded(p.ipaddr.IP, request(p.id+1, 9))))
+
+	// If the quoted request was truncated, the sequence can't be known
+	AssertNoError(t, p.processPacket(timeExceeded(p.ipaddr.IP, request(p.id, 10)[:4])))
+
+	if len(errs) != 2 {
+		t.Fatalf("Expected %v errors, got %v", 2, len(errs))
+	}
+	if errs[0].Type != ipv4.ICMPTypeTimeExceeded {
+		t.Errorf("Expected %v, got %v", ipv4.ICMPTypeTimeExceeded, errs[0].Type)
+	}
+	AssertEqualStrings(t, router.String(), errs[0].Src.String())
+	AssertEqualStrings(t, "192.0.2.1", errs[0].IPAddr.String())
+	if errs[0].Seq != 7 {
+		t.Errorf("Expected %v, got %v", 7, errs[0].Seq)
+	}
+	if errs[1].Seq != -1 {
+		t.Errorf("Expected %v, got %v", -1, errs[1].Seq)
+	}
+	if p.PacketsRecv != 0 {
+		t.Errorf("Expected %v, got %v", 0, p.PacketsRecv)
+	}
+}
+
+func TestOnRecvErrorIPv6(t *testing.T) {
+	p, err := NewPinger("2001:db8::1")
+	AssertNoError(t, err)
+
+	var errs []*PacketError
+	p.OnRecvError = func(e *PacketError) {
+		errs = append(errs, e)
+	}
+
+	request := marshalMessage(t, &icmp.Message{
+		Type: ipv6.ICMPTypeEchoRequest,
+		Body: &icmp.Echo{ID: p.id, Seq: 3, Data: timeToBytes(time.Now())},
+	})
+	quoted := make([]byte, 40)
+	quoted[0] = 6 << 4
+	quoted[6] = protocolIPv6ICMP
+	copy(quoted[24:40], p.ipaddr.IP)
+	b := marshalMessage(t, &icmp.Message{
+		Type: ipv6.ICMPTypeDestinationUnreachable,
+		Code: 3,
+		Body: &icmp.DstUnreach{Data: append(quoted, request...)},
+	})
+
+	src := &net.UDPAddr{IP: net.ParseIP("2001:db8::ff")}
+	AssertNoError(t, p.processPacket(&packet{bytes: b, nbytes: len(b), addr: src}))
+
+	if len(errs) != 1 {
+		t.Fatalf("Expected %v errors, got %v", 1, len(errs))
+	}
+	if errs[0].Type != ipv6.ICMPTypeDestinationUnreachable {
+		t.Errorf("Expected %v, got %v", ipv6.ICMPTypeDestinationUnreachable, errs[0].Type)
+	}
+	if errs[0].Code != 3 {
+		t.Errorf("Expected %v, got %v", 3, errs[0].Code)
+	}
+	if errs[0].Seq != 3 {
+		t.Errorf("Expected %v, got %v", 3, errs[0].Seq)
+	}
+	AssertEqualStrings(t, "2001:db8::ff", errs[0].Src.String())
+}
+
+func TestStatisticsPacketLoss(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+
+	// Nothing sent yet, so nothing lost
+	if loss := p.Statistics().PacketLoss; loss != 0 {
+		t.Errorf("Expected %v, got %v", 0.0, loss)
+	}
+
+	p.PacketsSent = 4
+	p.PacketsRecv = 3
+	if loss := p.Statistics().PacketLoss; loss != 25 {
+		t.Errorf("Expected %v, got %v", 25.0, loss)
+	}
+
+	// More replies than requests shouldn't give negative loss
+	p.PacketsRecv = 6
+	if loss := p.Statistics().PacketLoss; loss != 0 {
+		t.Errorf("Expected %v, got %v", 0.0, loss)
+	}
+
+	// Nor should excluding every packet
+	p.PacketsRecv = 0
+	p.excluded = 4
+	if loss := p.Statistics().PacketLoss; loss != 0 {
+		t.Errorf("Expected %v, got %v", 0.0, loss)
+	}
+}
+
+func TestStatisticsPercentile(t *testing.T) {
+	ms := func(ns ...int) []time.Duration {
+		rtts := make([]time.Duration, len(ns))
+		for i, n := range ns {
+			rtts[i] = time.Duration(n) * time.Millisecond
+		}
+		return rtts
+	}
+
+	tests := []struct {
+		rtts     []time.Duration
+		p        float64
+		expected time.Duration
+	}{
+		{nil, 50, 0},
+		{ms(7), 0, 7 * time.Millisecond},
+		{ms(7), 99, 7 * time.Millisecond},
+		{ms(4, 1, 3, 2), 0, 1 * time.Millisecond},
+		{ms(4, 1, 3, 2), 25, 1 * time.Millisecond},
+		{ms(4, 1, 3, 2), 26, 2 * time.Millisecond},
+		{ms(4, 1, 3, 2), 50, 2 * time.Millisecond},
+		{ms(4, 1, 3, 2), 75, 3 * time.Millisecond},
+		{ms(4, 1, 3, 2), 100, 4 * time.Millisecond},
+		{ms(15, 20, 35, 40, 50), 30, 20 * time.Millisecond},
+		{ms(15, 20, 35, 40, 50), 40, 20 * time.Millisecond},
+		{ms(15, 20, 35, 40, 50), 50, 35 * time.Millisecond},
+		{ms(1, 2, 3, 4, 5, 6, 7, 8, 9, 10), 70, 7 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		s := &Statistics{Rtts: test.rtts}
+		if got := s.Percentile(test.p); got != test.expected {
+			t.Errorf("Percentile(%v) of %v: expected %v, got %v",
+				test.p, test.rtts, test.expected, got)
+		}
+	}
+
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	for i := 100; i > 0; i-- {
+		p.rtts = append(p.rtts, time.Duration(i)*time.Millisecond)
+	}
+	stats := p.Statistics()
+	expected := map[string][2]time.Duration{
+		"P50Rtt": {50 * time.Millisecond, stats.P50Rtt},
+		"P90Rtt": {90 * time.Millisecond, stats.P90Rtt},
+		"P95Rtt": {95 * time.Millisecond, stats.P95Rtt},
+		"P99Rtt": {99 * time.Millisecond, stats.P99Rtt},
+	}
+	for name, v := range expected {
+		if v[0] != v[1] {
+			t.Errorf("%s: expected %v, got %v", name, v[0], v[1])
+		}
+	}
+
+	// The original order should be preserved
+	if stats.Rtts[0] != 100*time.Millisecond {
+		t.Errorf("Expected %v, got %v", 100*time.Millisecond, stats.Rtts[0])
+	}
+}
+
+func TestReset(t *testing.T) {
+	SkipUnlessPrivileged(t)
+
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.Count = 2
+	p.Interval = 10 * time.Millisecond
+
+	var seqs []int
+	p.OnRecv = func(pkt *Packet) {
+		seqs = append(seqs, pkt.Seq)
+	}
+
+	first, err := p.Run()
+	AssertNoError(t, err)
+	if first.PacketsSent != 2 || first.PacketsRecv != 2 {
+		t.Fatalf("Expected 2 sent and received, got %v and %v",
+			first.PacketsSent, first.PacketsRecv)
+	}
+
+	AssertNoError(t, p.Reset())
+	if stats := p.Statistics(); stats.PacketsSent != 0 || len(stats.Rtts) != 0 {
+		t.Errorf("Expected reset statistics, got %+v", stats)
+	}
+
+	seqs = nil
+	second, err := p.Run()
+	AssertNoError(t, err)
+	if second.PacketsSent != 2 || second.PacketsRecv != 2 {
+		t.Errorf("Expected 2 sent and received, got %v and %v",
+			second.PacketsSent, second.PacketsRecv)
+	}
+	if len(second.Rtts) != 2 {
+		t.Errorf("Expected %v rtts, got %v", 2, len(second.Rtts))
+	}
+	if second.PacketLoss != 0 {
+		t.Errorf("Expected %v, got %v", 0.0, second.PacketLoss)
+	}
+	if len(seqs) != 2 || seqs[0] != 0 || seqs[1] != 1 {
+		t.Errorf("Expected sequence numbers to restart from 0, got %v", seqs)
+	}
+}
+
+func TestResetWhileRunning(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.DryRun = true
+	p.Count = 1
+
+	var resetErr error
+	p.OnSend = func(pkt *Packet) {
+		resetErr = p.Reset()
+	}
+	_, err = p.Run()
+	AssertNoError(t, err)
+	AssertError(t, resetErr, "Reset")
+
+	// Once the run is over, it should work
+	AssertNoError(t, p.Reset())
+}
+
+func TestResetClearsStop(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.DryRun = true
+	p.Count = 3
+	p.Interval = time.Millisecond
+
+	// A stop waiting for the next run shouldn't survive a reset
+	p.Stop()
+	AssertNoError(t, p.Reset())
+	stats, err := p.Run()
+	AssertNoError(t, err)
+	if stats.PacketsSent != 3 {
+		t.Errorf("Expected %v, got %v", 3, stats.PacketsSent)
+	}
+}
+
+func TestStatisticsDuringRun(t *testing.T) {
+	SkipUnlessPrivileged(t)
+
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.Count = 20
+	p.Interval = 5 * time.Millisecond
+	p.ExpectedRtt = time.Second
+
+	done := make(chan struct{})
+	scraped := make(chan int)
+	go func() {
+		scrapes := 0
+		for {
+			select {
+			case <-done:
+				scraped <- scrapes
+				return
+			default:
+			}
+
+			stats := p.Statistics()
+			if stats.PacketsRecv > stats.PacketsSent {
+				t.Errorf("Received %v of %v packets", stats.PacketsRecv, stats.PacketsSent)
+			}
+			if len(stats.Rtts) != stats.PacketsRecv {
+				t.Errorf("Expected %v rtts, got %v", stats.PacketsRecv, len(stats.Rtts))
+			}
+			scrapes++
+		}
+	}()
+
+	stats, err := p.Run()
+	close(done)
+	AssertNoError(t, err)
+	if scrapes := <-scraped; scrapes == 0 {
+		t.Errorf("Expected statistics to be scraped during the run")
+	}
+	if stats.PacketsRecv != 20 {
+		t.Errorf("Expected %v, got %v", 20, stats.PacketsRecv)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	SkipUnlessPrivileged(t)
+
+	// Nothing answers on TEST-NET-3, so only the fallback timeout ends the run
+	p, err := NewPinger("203.0.113.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.Count = 2
+	p.Interval = 50 * time.Millisecond
+
+	_, err = p.Run()
+	if err != ErrTimeout {
+		t.Errorf("Expected %v, got %v", ErrTimeout, err)
+	}
+
+	// Cancelling our own context should be reported as such
+	AssertNoError(t, p.Reset())
+	ctx, cancel := context.WithCancel(context.Background())
+	p.OnSend = func(pkt *Packet) {
+		cancel()
+	}
+	_, err = p.RunContext(ctx)
+	if err != context.Canceled {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	SkipUnlessPrivileged(t)
+
+	// Nothing answers on TEST-NET-3, so every packet should time out
+	p, err := NewPinger("203.0.113.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.Count = 3
+	p.Interval = 50 * time.Millisecond
+	p.Timeout = 100 * time.Millisecond
+
+	var timedOut []int
+	p.OnTimeout = func(seq int) {
+		timedOut = append(timedOut, seq)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	stats, err := p.RunContext(ctx)
+	AssertNoError(t, err)
+
+	// The run should end once the last packet times out
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the run to end after about 200ms, took %v", elapsed)
+	}
+	if len(timedOut) != 3 || timedOut[0] != 0 || timedOut[1] != 1 || timedOut[2] != 2 {
+		t.Errorf("Expected sequences 0, 1 and 2 to time out, got %v", timedOut)
+	}
+	if stats.PacketsSent != 3 {
+		t.Errorf("Expected %v, got %v", 3, stats.PacketsSent)
+	}
+	if stats.Losses[LossTimeout] != 3 || stats.Losses[LossNoReply] != 0 {
+		t.Errorf("Expected 3 timeouts, got %v", stats.Losses)
+	}
+	if stats.PacketLoss != 100 {
+		t.Errorf("Expected %v, got %v", 100.0, stats.PacketLoss)
+	}
+}
+
+func TestTimeoutLateReply(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.Timeout = time.Second
+
+	recv := 0
+	p.OnRecv = func(pkt *Packet) {
+		recv++
+	}
+	dups := 0
+	p.OnDuplicateRecv = func(pkt *Packet) {
+		dups++
+	}
+
+	p.sent(16, time.Now().Add(-2*time.Second))
+	p.sent(16, time.Now())
+	if next := p.expire(time.Now()); next <= 0 || next > time.Second {
+		t.Errorf("Expected the next timeout within %v, got %v", time.Second, next)
+	}
+
+	// A reply to the packet which timed out should be ignored
+	late := marshalMessage(t, &icmp.Message{
+		Type: ipv4.ICMPTypeEchoReply,
+		Body: &icmp.Echo{Seq: 0, Data: timeToBytes(time.Now())},
+	})
+	AssertNoError(t, p.processPacket(&packet{bytes: late, nbytes: len(late)}))
+	if recv != 0 || dups != 0 {
+		t.Errorf("Expected the late reply to be ignored, got %v replies and %v duplicates", recv, dups)
+	}
+
+	stats := p.Statistics()
+	if stats.Losses[LossTimeout] != 1 {
+		t.Errorf("Expected %v, got %v", 1, stats.Losses[LossTimeout])
+	}
+	if stats.PacketsRecv != 0 {
+		t.Errorf("Expected %v, got %v", 0, stats.PacketsRecv)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	SkipUnlessPrivileged(t)
+
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.Interval = 100 * time.Millisecond
+	p.Deadline = 1500 * time.Millisecond
+
+	start := time.Now()
+	stats, err := p.Run()
+	elapsed := time.Since(start)
+	AssertNoError(t, err)
+	if elapsed < 1400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Expected to stop after about 1.5s, took %v", elapsed)
+	}
+	if stats.PacketsSent < 10 || stats.PacketsRecv == 0 {
+		t.Errorf("Expected about 15 packets sent and received, got %v and %v",
+			stats.PacketsSent, stats.PacketsRecv)
+	}
+
+	// With a count, whichever comes first should end the run
+	AssertNoError(t, p.Reset())
+	p.Count = 2
+	start = time.Now()
+	stats, err = p.Run()
+	AssertNoError(t, err)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the count to end the run first, took %v", elapsed)
+	}
+	if stats.PacketsRecv != 2 {
+		t.Errorf("Expected %v, got %v", 2, stats.PacketsRecv)
+	}
+}
+
+func TestSetPayloadPattern(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	AssertNoError(t, p.SetPayloadSize(8+7))
+
+	data := func() []byte {
+		b, err := p.marshalEcho()
+		AssertNoError(t, err)
+		m, err := icmp.ParseMessage(protocolICMP, b)
+		AssertNoError(t, err)
+		return m.Body.(*icmp.Echo).Data[timeSliceLength:]
+	}
+
+	tests := []struct {
+		pattern  []byte
+		expected []byte
+	}{
+		{nil, []byte{1, 1, 1, 1, 1, 1, 1}},
+		{[]byte{0xab}, []byte{0xab, 0xab, 0xab, 0xab, 0xab, 0xab, 0xab}},
+		{[]byte{1, 2, 3}, []byte{1, 2, 3, 1, 2, 3, 1}},
+		{[]byte{1, 2, 3, 4, 5, 6, 7, 8, 9}, []byte{1, 2, 3, 4, 5, 6, 7}},
+		{[]byte{}, []byte{1, 1, 1, 1, 1, 1, 1}},
+	}
+	for _, test := range tests {
+		p.SetPayloadPattern(test.pattern)
+		if got := data(); !bytes.Equal(got, test.expected) {
+			t.Errorf("Pattern %v: expected %v, got %v", test.pattern, test.expected, got)
+		}
+	}
+
+	// The pattern should be copied
+	pattern := []byte{4, 5}
+	p.SetPayloadPattern(pattern)
+	pattern[0] = 0
+	if got := data(); got[0] != 4 {
+		t.Errorf("Expected %v, got %v", 4, got[0])
+	}
+}
+
+func TestSetOSProfile(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+
+	data := func() []byte {
+		b, err := p.marshalEcho()
+		AssertNoError(t, err)
+		m, err := icmp.ParseMessage(protocolICMP, b)
+		AssertNoError(t, err)
+		return m.Body.(*icmp.Echo).Data
+	}
+
+	linux := make([]byte, 56-timeSliceLength)
+	for i := range linux {
+		linux[i] = byte(0x08 + i)
+	}
+	tests := []struct {
+		profile OSProfile
+		ttl     int
+		size    int
+		padding []byte
+	}{
+		{OSLinux, 64, 56, linux},
+		{OSWindows, 128, 32, []byte("ijklmnopqrstuvwabcdefghi")},
+		{OSMacOS, 64, 56, linux},
+	}
+	for _, test := range tests {
+		AssertNoError(t, p.SetOSProfile(test.profile))
+		if p.TTL() != test.ttl {
+			t.Errorf("%v: expected a TTL of %v, got %v", test.profile, test.ttl, p.TTL())
+		}
+		if p.PayloadSize() != test.size {
+			t.Errorf("%v: expected a size of %v, got %v", test.profile, test.size, p.PayloadSize())
+		}
+		got := data()
+		if len(got) != test.size {
+			t.Errorf("%v: expected %v data bytes, got %v", test.profile, test.size, len(got))
+		} else if !bytes.Equal(got[timeSliceLength:], test.padding) {
+			t.Errorf("%v: expected %q, got %q", test.profile, test.padding, got[timeSliceLength:])
+		}
+	}
+
+	// An unknown profile should leave things as they were
+	AssertError(t, p.SetOSProfile(OSProfile(42)), "OSProfile(42)")
+	if p.TTL() != 64 || p.PayloadSize() != 56 {
+		t.Errorf("Expected the macOS profile to be kept, got a TTL of %v and size %v",
+			p.TTL(), p.PayloadSize())
+	}
+}
+
+func TestSetInterface(t *testing.T) {
+	SkipUnlessPrivileged(t)
+
+	lo := "lo"
+	if runtime.GOOS != "linux" {
+		lo = "lo0"
+	}
+	if _, err := net.InterfaceByName(lo); err != nil {
+		t.Skipf("No %s interface: %s", lo, err)
+	}
+
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.Count = 1
+
+	err = p.SetInterface("nonexistent0")
+	AssertError(t, err, "nonexistent0")
+	AssertEqualStrings(t, "", p.Interface())
+
+	AssertNoError(t, p.SetInterface(lo))
+	AssertEqualStrings(t, lo, p.Interface())
+
+	stats, err := p.Run()
+	AssertNoError(t, err)
+	if stats.PacketsRecv != 1 {
+		t.Errorf("Expected %v, got %v", 1, stats.PacketsRecv)
+	}
+}
+
+func TestSetSource(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.Count = 1
+
+	AssertError(t, p.SetSource("127.0.0.0.1"), "invalid address")
+	AssertError(t, p.SetSource("::1"), "mismatched family")
+	AssertEqualStrings(t, "", p.Source())
+
+	AssertNoError(t, p.SetSource("127.0.0.1"))
+	AssertEqualStrings(t, "127.0.0.1", p.Source())
+
+	// Switching the target to IPv6 should be caught when the run starts
+	p.SetIPAddr(&net.IPAddr{IP: net.IPv6loopback})
+	_, err = p.Run()
+	AssertError(t, err, "mismatched family")
+
+	SkipUnlessPrivileged(t)
+
+	p.SetIPAddr(&net.IPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	stats, err := p.Run()
+	AssertNoError(t, err)
+	if stats.PacketsRecv != 1 {
+		t.Errorf("Expected %v, got %v", 1, stats.PacketsRecv)
+	}
+}
+
+func TestSetIPAddrWhileRunning(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	conn := newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		return []*icmp.Message{echoReply(req)}
+	})
+	p.SetConn(conn)
+	p.Count = 2
+	p.Interval = time.Millisecond
+	var buf bytes.Buffer
+	p.SetLogger(StdLogger{Logger: log.New(&buf, "", 0)})
+
+	// The socket is open for IPv4, so switching to IPv6 mid-run should be
+	// refused rather than sending IPv6 echoes down it
+	p.OnSend = func(pkt *Packet) {
+		p.SetIPAddr(&net.IPAddr{IP: net.IPv6loopback})
+	}
+	stats, err := p.Run()
+	AssertNoError(t, err)
+	if stats.PacketsRecv != 2 {
+		t.Errorf("Expected %v, got %v", 2, stats.PacketsRecv)
+	}
+	for _, m := range conn.Written() {
+		if m.Type != ipv4.ICMPTypeEcho {
+			t.Errorf("Expected %v, got %v", ipv4.ICMPTypeEcho, m.Type)
+		}
+	}
+	AssertEqualStrings(t, "127.0.0.1", p.IPAddr().String())
+	if !bytes.Contains(buf.Bytes(), []byte("while running")) {
+		t.Errorf("Expected the change to be logged, got %q", buf.String())
+	}
+
+	// Once the run is over, it's fine
+	p.OnSend = nil
+	p.SetIPAddr(&net.IPAddr{IP: net.IPv6loopback})
+	AssertEqualStrings(t, "::1", p.IPAddr().String())
+}
+
+func TestSetTrafficClass(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.Count = 1
+
+	AssertError(t, p.SetTrafficClass(-1), "-1")
+	AssertError(t, p.SetTrafficClass(256), "256")
+	if p.TrafficClass() != 0 {
+		t.Errorf("Expected %v, got %v", 0, p.TrafficClass())
+	}
+
+	AssertNoError(t, p.SetTrafficClass(184))
+	if p.TrafficClass() != 184 {
+		t.Errorf("Expected %v, got %v", 184, p.TrafficClass())
+	}
+
+	SkipUnlessPrivileged(t)
+
+	for _, addr := range []string{"127.0.0.1", "::1"} {
+		AssertNoError(t, p.SetAddr(addr))
+		AssertNoError(t, p.Reset())
+		stats, err := p.Run()
+		AssertNoError(t, err)
+		if stats.PacketsRecv != 1 {
+			t.Errorf("Expected %v from %s, got %v", 1, addr, stats.PacketsRecv)
+		}
+	}
+}
+
+func TestFlood(t *testing.T) {
+	SkipUnlessPrivileged(t)
+
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.Count = 20
+	p.Interval = time.Second
+	p.Flood = true
+
+	start := time.Now()
+	stats, err := p.Run()
+	elapsed := time.Since(start)
+	AssertNoError(t, err)
+	if stats.PacketsSent != 20 || stats.PacketsRecv != 20 {
+		t.Errorf("Expected 20 sent and received, got %v and %v",
+			stats.PacketsSent, stats.PacketsRecv)
+	}
+
+	// At one packet per interval this would take 19s
+	if elapsed > 2*time.Second {
+		t.Errorf("Expected flood mode to ignore the interval, took %v", elapsed)
+	}
+	if elapsed < 19*floodMinInterval {
+		t.Errorf("Expected flood mode to wait at least %v between packets, took %v",
+			floodMinInterval, elapsed)
+	}
+}
+
+func TestFloodLostReply(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.SetConn(newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		if req.Body.(*icmp.Echo).Seq == 2 {
+			return nil
+		}
+		return []*icmp.Message{echoReply(req)}
+	}))
+	p.Interval = time.Second
+	p.Flood = true
+
+	// Without a Timeout the lost packet stays outstanding, so time the sends
+	// after it instead of waiting for the run to complete
+	var start, end time.Time
+	p.OnSend = func(pkt *Packet) {
+		switch pkt.Seq {
+		case 3:
+			start = time.Now()
+		case 43:
+			end = time.Now()
+			p.Stop()
+		}
+	}
+
+	stats, err := p.Run()
+	AssertNoError(t, err)
+	if stats.PacketsRecv < 42 {
+		t.Errorf("Expected at least %v received, got %v", 42, stats.PacketsRecv)
+	}
+
+	// Falling back to one packet every floodMaxInterval would take 400ms
+	if elapsed := end.Sub(start); elapsed > 40*floodMaxInterval/2 {
+		t.Errorf("Expected replies to keep triggering sends, took %v", elapsed)
+	}
+}
+
+func TestSetConn(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.Count = 3
+	p.Interval = 10 * time.Millisecond
+
+	conn := newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		return []*icmp.Message{echoReply(req)}
+	})
+	p.SetConn(conn)
+
+	var seqs []int
+	p.OnRecv = func(pkt *Packet) {
+		seqs = append(seqs, pkt.Seq)
+	}
+
+	for run := 0; run < 2; run++ {
+		seqs = nil
+		stats, err := p.Run()
+		AssertNoError(t, err)
+		if stats.PacketsSent != 3 || stats.PacketsRecv != 3 {
+			t.Errorf("Expected 3 sent and received, got %v and %v",
+				stats.PacketsSent, stats.PacketsRecv)
+		}
+		if len(seqs) != 3 || seqs[0] != 0 || seqs[2] != 2 {
+			t.Errorf("Expected replies to sequences 0 to 2, got %v", seqs)
+		}
+
+		// The conn should be reusable for another run
+		AssertNoError(t, p.Reset())
+	}
+
+	written := conn.Written()
+	if len(written) != 6 {
+		t.Fatalf("Expected %v requests, got %v", 6, len(written))
+	}
+	echo := written[0].Body.(*icmp.Echo)
+	if written[0].Type != ipv4.ICMPTypeEcho || echo.ID != p.id || echo.Seq != 0 {
+		t.Errorf("Expected an echo request with ID %v and seq 0, got %+v", p.id, echo)
+	}
+}
+
+func TestSetConnReplies(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   func(req *icmp.Message) []*icmp.Message
+		recv    int
+		dups    int
+		errs    int
+		timeout int
+	}{
+		{
+			name: "duplicated",
+			reply: func(req *icmp.Message) []*icmp.Message {
+				return []*icmp.Message{echoReply(req), echoReply(req)}
+			},
+			// The run ends as soon as the last reply arrives, before its
+			// duplicate
+			recv: 3, dups: 2,
+		},
+		{
+			name: "truncated",
+			reply: func(req *icmp.Message) []*icmp.Message {
+				reply := echoReply(req)
+				reply.Body.(*icmp.Echo).Data = nil
+				return []*icmp.Message{reply}
+			},
+			recv: 3,
+		},
+		{
+			name: "other pinger",
+			reply: func(req *icmp.Message) []*icmp.Message {
+				reply := echoReply(req)
+				reply.Body.(*icmp.Echo).ID++
+				return []*icmp.Message{reply}
+			},
+			timeout: 3,
+		},
+		{
+			name: "time exceeded",
+			reply: func(req *icmp.Message) []*icmp.Message {
+				b, err := req.Marshal(nil)
+				if err != nil {
+					panic(err)
+				}
+				h, err := (&ipv4.Header{
+					Version:  4,
+					Len:      ipv4.HeaderLen,
+					TotalLen: ipv4.HeaderLen + len(b),
+					TTL:      1,
+					Protocol: protocolICMP,
+					Dst:      net.IPv4(127, 0, 0, 1),
+				}).Marshal()
+				if err != nil {
+					panic(err)
+				}
+				return []*icmp.Message{{
+					Type: ipv4.ICMPTypeTimeExceeded,
+					Body: &icmp.TimeExceeded{Data: append(h, b...)},
+				}}
+			},
+			errs: 3, timeout: 3,
+		},
+	}
+
+	for _, test := range tests {
+		p, err := NewPinger("127.0.0.1")
+		AssertNoError(t, err)
+		p.SetPrivileged(true)
+		p.Count = 3
+		p.Interval = 10 * time.Millisecond
+		p.Timeout = 50 * time.Millisecond
+		p.SetConn(newFakeConn(test.reply))
+
+		errs, timeouts := 0, 0
+		p.OnRecvError = func(e *PacketError) {
+			errs++
+		}
+		p.OnTimeout = func(seq int) {
+			timeouts++
+		}
+
+		stats, err := p.Run()
+		AssertNoError(t, err)
+		if stats.PacketsRecv != test.recv || stats.PacketsRecvDuplicates != test.dups {
+			t.Errorf("%s: expected %v received and %v duplicates, got %v and %v", test.name,
+				test.recv, test.dups, stats.PacketsRecv, stats.PacketsRecvDuplicates)
+		}
+		if errs != test.errs || timeouts != test.timeout {
+			t.Errorf("%s: expected %v errors and %v timeouts, got %v and %v", test.name,
+				test.errs, test.timeout, errs, timeouts)
+		}
+	}
+}
+
+func TestReResolve(t *testing.T) {
+	var mu sync.Mutex
+	ip := net.IPv4(127, 0, 0, 1)
+	setIP := func(next net.IP) {
+		mu.Lock()
+		defer mu.Unlock()
+		ip = next
+	}
+
+	defer stubLookupIPAddr(func(host string) ([]net.IPAddr, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return []net.IPAddr{{IP: ip}}, nil
+	})()
+
+	p, err := NewPinger("pinger.example")
+	AssertNoError(t, err)
+	AssertEqualStrings(t, "127.0.0.1", p.IPAddr().String())
+
+	// Outside a run, the address can change in any way
+	setIP(net.IPv6loopback)
+	AssertNoError(t, p.ReResolve())
+	AssertEqualStrings(t, "::1", p.IPAddr().String())
+	AssertEqualStrings(t, "pinger.example", p.Addr())
+	setIP(net.IPv4(127, 0, 0, 1))
+	AssertNoError(t, p.ReResolve())
+
+	p.SetPrivileged(true)
+	p.Count = 6
+	p.Interval = 20 * time.Millisecond
+	p.ResolveInterval = 10 * time.Millisecond
+	p.SetConn(newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		return []*icmp.Message{echoReply(req)}
+	}))
+
+	var sentMu sync.Mutex
+	var sentTo []string
+	p.OnSend = func(pkt *Packet) {
+		sentMu.Lock()
+		defer sentMu.Unlock()
+		sentTo = append(sentTo, pkt.IPAddr.String())
+
+		switch len(sentTo) {
+		case 2:
+			setIP(net.IPv4(127, 0, 0, 2))
+		case 4:
+			// A change of family can't be followed mid-run
+			setIP(net.IPv6loopback)
+		}
+	}
+
+	stats, err := p.Run()
+	AssertNoError(t, err)
+	if stats.PacketsRecv != 6 {
+		t.Errorf("Expected %v, got %v", 6, stats.PacketsRecv)
+	}
+
+	if len(sentTo) != 6 {
+		t.Fatalf("Expected %v packets, got %v", 6, len(sentTo))
+	}
+	AssertEqualStrings(t, "127.0.0.1", sentTo[0])
+	for _, addr := range sentTo[4:] {
+		AssertEqualStrings(t, "127.0.0.2", addr)
+	}
+	AssertEqualStrings(t, "127.0.0.2", p.IPAddr().String())
+}
+
+func TestStatisticsJitter(t *testing.T) {
+	ms := func(ns ...int) []time.Duration {
+		rtts := make([]time.Duration, len(ns))
+		for i, n := range ns {
+			rtts[i] = time.Duration(n) * time.Millisecond
+		}
+		return rtts
+	}
+
+	tests := []struct {
+		rtts     []time.Duration
+		expected time.Duration
+	}{
+		{nil, 0},
+		{ms(10), 0},
+		{ms(10, 10, 10), 0},
+		{ms(10, 20), 10 * time.Millisecond},
+		{ms(10, 20, 10, 20), 10 * time.Millisecond},
+		{ms(10, 14, 12, 18), 4 * time.Millisecond},
+		{ms(30, 20, 10), 10 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		p, err := NewPinger("127.0.0.1")
+		AssertNoError(t, err)
+		p.rtts = test.rtts
+		if got := p.Statistics().Jitter; got != test.expected {
+			t.Errorf("Jitter of %v: expected %v, got %v", test.rtts, test.expected, got)
+		}
+	}
+}
+
+func TestLossStreak(t *testing.T) {
+	tests := []struct {
+		name    string
+		answer  func(seq int) bool
+		streaks []int
+		max     int
+	}{
+		{"unreachable", func(seq int) bool { return false }, []int{1, 2, 3, 4, 5}, 5},
+		{"outage", func(seq int) bool { return seq == 0 || seq == 3 }, []int{1, 2, 0, 1}, 2},
+		{"healthy", func(seq int) bool { return true }, nil, 0},
+	}
+
+	for _, test := range tests {
+		p, err := NewPinger("127.0.0.1")
+		AssertNoError(t, err)
+		p.SetPrivileged(true)
+		p.Count = 5
+		p.Interval = 30 * time.Millisecond
+		p.Timeout = 10 * time.Millisecond
+
+		answer := test.answer
+		p.SetConn(newFakeConn(func(req *icmp.Message) []*icmp.Message {
+			if !answer(req.Body.(*icmp.Echo).Seq) {
+				return nil
+			}
+			return []*icmp.Message{echoReply(req)}
+		}))
+
+		var streaks []int
+		p.OnLossStreak = func(consecutive int) {
+			streaks = append(streaks, consecutive)
+		}
+
+		stats, err := p.Run()
+		AssertNoError(t, err)
+		if len(streaks) != len(test.streaks) {
+			t.Errorf("%s: expected streaks %v, got %v", test.name, test.streaks, streaks)
+		} else {
+			for i := range streaks {
+				if streaks[i] != test.streaks[i] {
+					t.Errorf("%s: expected streaks %v, got %v", test.name, test.streaks, streaks)
+					break
+				}
+			}
+		}
+		if stats.MaxConsecutiveLoss != test.max {
+			t.Errorf("%s: expected %v, got %v", test.name, test.max, stats.MaxConsecutiveLoss)
+		}
+	}
+}
+
+func TestSendErrors(t *testing.T) {
+	always := func(errno syscall.Errno) func(int) syscall.Errno {
+		return func(int) syscall.Errno { return errno }
+	}
+	first := func(n int, errno syscall.Errno) func(int) syscall.Errno {
+		return func(i int) syscall.Errno {
+			if i < n {
+				return errno
+			}
+			return 0
+		}
+	}
+
+	tests := []struct {
+		name     string
+		writeErr func(int) syscall.Errno
+		err      syscall.Errno
+		sent     int
+		writes   int
+	}{
+		// Fatal errors end the run straight away
+		{"permission denied", always(syscall.EACCES), syscall.EACCES, 0, 1},
+		{"not permitted", always(syscall.EPERM), syscall.EPERM, 0, 1},
+		{"network unreachable", always(syscall.ENETUNREACH), syscall.ENETUNREACH, 0, 1},
+		{"invalid argument", always(syscall.EINVAL), syscall.EINVAL, 0, 1},
+
+		// Transient errors are retried
+		{"no buffer space", first(2, syscall.ENOBUFS), 0, 3, 5},
+
+		// Other errors lose the packet, but the run carries on
+		{"host unreachable", first(1, syscall.EHOSTUNREACH), 0, 3, 4},
+	}
+
+	for _, test := range tests {
+		p, err := NewPinger("127.0.0.1")
+		AssertNoError(t, err)
+		p.SetPrivileged(true)
+		p.Count = 3
+		p.Interval = 10 * time.Millisecond
+		p.Deadline = time.Second
+
+		conn := newFakeConn(func(req *icmp.Message) []*icmp.Message {
+			return []*icmp.Message{echoReply(req)}
+		})
+		conn.writeErr = test.writeErr
+		p.SetConn(conn)
+
+		stats, err := p.Run()
+		if test.err != 0 {
+			if errno, _ := errnoOf(err); errno != test.err {
+				t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+			}
+		} else {
+			AssertNoError(t, err)
+		}
+		if stats != nil && stats.PacketsSent != test.sent {
+			t.Errorf("%s: expected %v sent, got %v", test.name, test.sent, stats.PacketsSent)
+		}
+		if conn.writes != test.writes {
+			t.Errorf("%s: expected %v writes, got %v", test.name, test.writes, conn.writes)
+		}
+	}
+}
+
+func TestSendRetryLimit(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.Interval = 10 * time.Millisecond
+	p.Deadline = 200 * time.Millisecond
+
+	conn := newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		return []*icmp.Message{echoReply(req)}
+	})
+	conn.writeErr = func(int) syscall.Errno { return syscall.ENOBUFS }
+	p.SetConn(conn)
+
+	// Each packet is given up on after the last retry, rather than being
+	// retried forever.
+	stats, err := p.Run()
+	AssertNoError(t, err)
+	if stats.PacketsSent != 0 {
+		t.Errorf("Expected %v sent, got %v", 0, stats.PacketsSent)
+	}
+	if conn.writes < 2*(sendMaxRetries+1) || conn.writes%(sendMaxRetries+1) != 0 {
+		t.Errorf("Expected a multiple of %v writes, got %v", sendMaxRetries+1, conn.writes)
+	}
+}
+
+func TestZonedAddr(t *testing.T) {
+	p, err := NewPinger("fe80::1%lo")
+	AssertNoError(t, err)
+	AssertEqualStrings(t, "fe80::1%lo", p.Addr())
+	AssertEqualStrings(t, "lo", p.IPAddr().Zone)
+	AssertFalse(t, p.ipv4)
+
+	p.SetIPAddr(&net.IPAddr{IP: net.ParseIP("fe80::2"), Zone: "eth0"})
+	AssertEqualStrings(t, "fe80::2%eth0", p.Addr())
+	AssertEqualStrings(t, "eth0", p.IPAddr().Zone)
+
+	// The zone has to make it to the socket, or the kernel won't know which
+	// link to send on
+	for _, privileged := range []bool{false, true} {
+		p.SetPrivileged(privileged)
+		conn := newFakeConn(func(req *icmp.Message) []*icmp.Message { return nil })
+		AssertNoError(t, p.sendICMP(conn))
+
+		var zone string
+		switch dst := conn.dsts[0].(type) {
+		case *net.UDPAddr:
+			AssertFalse(t, privileged)
+			zone = dst.Zone
+		case *net.IPAddr:
+			AssertTrue(t, privileged)
+			zone = dst.Zone
+		default:
+			t.Fatalf("Unexpected destination %T", dst)
+		}
+		AssertEqualStrings(t, "eth0", zone)
+	}
+}
+
+func TestIPv4MappedAddr(t *testing.T) {
+	ip := net.ParseIP("::ffff:127.0.0.1")
+	if len(ip) != net.IPv6len {
+		t.Fatalf("Expected a %d byte address, got %d", net.IPv6len, len(ip))
+	}
+	AssertTrue(t, isIPv4(ip))
+	AssertFalse(t, isIPv6(ip))
+	AssertTrue(t, isIPv6(net.ParseIP("::1")))
+	AssertFalse(t, isIPv4(net.ParseIP("::1")))
+
+	p, err := NewPinger("::ffff:127.0.0.1")
+	AssertNoError(t, err)
+	AssertTrue(t, p.ipv4)
+}
+
+func TestSetID(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+
+	if p.ID() < 0 || p.ID() > 0xffff {
+		t.Errorf("Expected an ID between 0 and 65535, got %v", p.ID())
+	}
+
+	AssertError(t, p.SetID(-1), "-1")
+	AssertError(t, p.SetID(0x10000), "65536")
+	AssertNoError(t, p.SetID(0xbeef))
+	if p.ID() != 0xbeef {
+		t.Errorf("Expected %v, got %v", 0xbeef, p.ID())
+	}
+
+	p.Count = 2
+	p.Interval = 10 * time.Millisecond
+	conn := newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		return []*icmp.Message{echoReply(req)}
+	})
+	p.SetConn(conn)
+
+	stats, err := p.Run()
+	AssertNoError(t, err)
+	if len(conn.Written()) != 2 {
+		t.Errorf("Expected %v packets written, got %v", 2, len(conn.Written()))
+	}
+	for _, m := range conn.Written() {
+		if id := m.Body.(*icmp.Echo).ID; id != 0xbeef {
+			t.Errorf("Expected ID %v, got %v", 0xbeef, id)
+		}
+	}
+	// Replies with the ID are ours
+	if stats.PacketsRecv != 2 {
+		t.Errorf("Expected %v, got %v", 2, stats.PacketsRecv)
+	}
+}
+
+func TestSetStatsBufferLimit(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	AssertError(t, p.SetStatsBufferLimit(-1), "-1")
+
+	// Any round-trip times already recorded count towards the totals
+	p.addRtt(time.Millisecond)
+	AssertNoError(t, p.SetStatsBufferLimit(100))
+
+	var total time.Duration
+	n := 100000
+	total += time.Millisecond
+	for i := 1; i < n; i++ {
+		rtt := time.Duration(i%1000+1) * time.Microsecond
+		total += rtt
+		p.mu.Lock()
+		p.PacketsRecv++
+		p.addRtt(rtt)
+		p.mu.Unlock()
+	}
+
+	if len(p.rtts) != 100 || cap(p.rtts) != 100 {
+		t.Errorf("Expected 100 round-trip times kept, got %v (capacity %v)",
+			len(p.rtts), cap(p.rtts))
+	}
+
+	stats := p.Statistics()
+	if len(stats.Rtts) != 100 {
+		t.Fatalf("Expected %v, got %v", 100, len(stats.Rtts))
+	}
+	// The most recent, oldest first
+	for i, rtt := range stats.Rtts {
+		expected := time.Duration((n-100+i)%1000+1) * time.Microsecond
+		if rtt != expected {
+			t.Fatalf("Rtts[%d]: expected %v, got %v", i, expected, rtt)
+		}
+	}
+
+	if expected := total / time.Duration(n); stats.AvgRtt != expected {
+		t.Errorf("Expected average %v, got %v", expected, stats.AvgRtt)
+	}
+	if stats.TotalRtt != total {
+		t.Errorf("Expected total %v, got %v", total, stats.TotalRtt)
+	}
+	if stats.MinRtt != time.Microsecond {
+		t.Errorf("Expected %v, got %v", time.Microsecond, stats.MinRtt)
+	}
+	if stats.MaxRtt != time.Millisecond {
+		t.Errorf("Expected %v, got %v", time.Millisecond, stats.MaxRtt)
+	}
+	// Uniform over 1us to 1ms
+	if stddev := stats.StdDevRtt; stddev < 288*time.Microsecond || stddev > 289*time.Microsecond {
+		t.Errorf("Expected a standard deviation around 288.7us, got %v", stddev)
+	}
+	// The percentiles are of the last 100, which are 901us to 1ms
+	if stats.P50Rtt != 950*time.Microsecond {
+		t.Errorf("Expected %v, got %v", 950*time.Microsecond, stats.P50Rtt)
+	}
+
+	// Without a limit, the same stats come from every round-trip time
+	unlimited, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	unlimited.addRtt(time.Millisecond)
+	for i := 1; i < n; i++ {
+		unlimited.addRtt(time.Duration(i%1000+1) * time.Microsecond)
+	}
+	all := unlimited.Statistics()
+	if all.AvgRtt != stats.AvgRtt || all.MinRtt != stats.MinRtt ||
+		all.MaxRtt != stats.MaxRtt || all.Jitter != stats.Jitter {
+		t.Errorf("Expected %v/%v/%v/%v, got %v/%v/%v/%v",
+			all.MinRtt, all.AvgRtt, all.MaxRtt, all.Jitter,
+			stats.MinRtt, stats.AvgRtt, stats.MaxRtt, stats.Jitter)
+	}
+	if d := all.StdDevRtt - stats.StdDevRtt; d < -time.Nanosecond || d > time.Nanosecond {
+		t.Errorf("Expected %v, got %v", all.StdDevRtt, stats.StdDevRtt)
+	}
+
+	AssertNoError(t, p.Reset())
+	if stats := p.Statistics(); len(stats.Rtts) != 0 || stats.AvgRtt != 0 {
+		t.Errorf("Expected no round-trip times after Reset, got %v", stats.Rtts)
+	}
+}
+
+func TestRecvBufferReuse(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.sent(16, time.Now())
+
+	var msg *icmp.Message
+	p.OnMessage = func(m *icmp.Message, src net.Addr) {
+		msg = m
+	}
+	var recv *Packet
+	p.OnRecv = func(pkt *Packet) {
+		recv = pkt
+	}
+
+	data := timeToBytes(time.Now())
+	reply := marshalMessage(t, &icmp.Message{
+		Type: ipv4.ICMPTypeEchoReply,
+		Body: &icmp.Echo{Seq: 0, Data: data},
+	})
+	buf := newRecvBuffer(p.recvBufferSize())
+	n := copy(*buf, reply)
+	pkt := &packet{bytes: *buf, nbytes: n, buf: buf}
+	AssertNoError(t, p.processPacket(pkt))
+	if pkt.buf != nil || pkt.bytes != nil {
+		t.Error("Expected the buffer to be released")
+	}
+
+	// Whoever gets the buffer next mustn't be able to change what we parsed
+	// from it
+	for i := range *buf {
+		(*buf)[i] = 0xff
+	}
+	if msg == nil || recv == nil {
+		t.Fatal("Expected the reply to be received")
+	}
+	if !bytes.Equal(msg.Body.(*icmp.Echo).Data, data) {
+		t.Errorf("Expected %v, got %v", data, msg.Body.(*icmp.Echo).Data)
+	}
+	if recv.Seq != 0 || recv.Nbytes != n {
+		t.Errorf("Expected seq 0 and %v bytes, got %v and %v", n, recv.Seq, recv.Nbytes)
+	}
+}
+
+func BenchmarkRecv(b *testing.B) {
+	p, err := NewPinger("127.0.0.1")
+	if err != nil {
+		b.Fatal(err)
+	}
+	p.SetPrivileged(true)
+	if err := p.SetStatsBufferLimit(16); err != nil {
+		b.Fatal(err)
+	}
+
+	reply, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeEchoReply,
+		Body: &icmp.Echo{ID: p.id, Seq: 100, Data: timeToBytes(time.Now())},
+	}).Marshal(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn := &benchConn{reply: reply, addr: &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	recv := make(chan *packet, 5)
+	wg.Add(1)
+	go recvICMP(ctx, conn, p.recvBufferSize(), recv, wg)
+	defer func() {
+		cancel()
+		for {
+			select {
+			case <-recv:
+			default:
+				wg.Wait()
+				return
+			}
+		}
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := p.processPacket(<-recv); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestPacketSrc(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.Count = 2
+	p.Interval = 10 * time.Millisecond
+
+	// Another host answering for the target
+	conn := newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		return []*icmp.Message{echoReply(req)}
+	})
+	conn.src = &net.IPAddr{IP: net.ParseIP("127.0.0.2")}
+	p.SetConn(conn)
+
+	var recv []*Packet
+	p.OnRecv = func(pkt *Packet) {
+		recv = append(recv, pkt)
+	}
+	p.OnSend = func(pkt *Packet) {
+		if pkt.Src != nil {
+			t.Errorf("Expected no source for a sent packet, got %v", pkt.Src)
+		}
+	}
+
+	_, err = p.Run()
+	AssertNoError(t, err)
+	if len(recv) != 2 {
+		t.Fatalf("Expected %v replies, got %v", 2, len(recv))
+	}
+	for _, pkt := range recv {
+		AssertEqualStrings(t, "127.0.0.2", pkt.Src.String())
+		AssertEqualStrings(t, "127.0.0.1", pkt.IPAddr.String())
+	}
+
+	// In unprivileged mode, the source comes as a UDP address
+	p.SetPrivileged(false)
+	AssertNoError(t, p.Reset())
+	recv = nil
+	conn = newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		return []*icmp.Message{echoReply(req)}
+	})
+	conn.src = &net.UDPAddr{IP: net.ParseIP("127.0.0.3")}
+	p.SetConn(conn)
+
+	_, err = p.Run()
+	AssertNoError(t, err)
+	if len(recv) != 2 {
+		t.Fatalf("Expected %v replies, got %v", 2, len(recv))
+	}
+	AssertEqualStrings(t, "127.0.0.3", recv[0].Src.String())
+}
+
+func TestSetNetwork(t *testing.T) {
+	var addrs []net.IPAddr
+	defer stubLookupIPAddr(func(host string) ([]net.IPAddr, error) {
+		return addrs, nil
+	})()
+
+	addrs = []net.IPAddr{
+		{IP: net.ParseIP("fe80::1"), Zone: "lo"},
+		{IP: net.ParseIP("127.0.0.2")},
+		{IP: net.ParseIP("::1")},
+		{IP: net.ParseIP("127.0.0.3")},
+	}
+	p, err := NewPinger("pinger.example")
+	AssertNoError(t, err)
+	AssertEqualStrings(t, "ip", p.Network())
+
+	// IPv4 is preferred, and the first address of the family is used
+	AssertEqualStrings(t, "127.0.0.2", p.IPAddr().String())
+	AssertTrue(t, p.ipv4)
+
+	AssertNoError(t, p.SetNetwork("ip6"))
+	AssertEqualStrings(t, "ip6", p.Network())
+	AssertEqualStrings(t, "fe80::1%lo", p.IPAddr().String())
+	AssertFalse(t, p.ipv4)
+
+	AssertNoError(t, p.SetNetwork("ip4"))
+	AssertEqualStrings(t, "127.0.0.2", p.IPAddr().String())
+
+	AssertError(t, p.SetNetwork("udp"), "udp")
+	AssertEqualStrings(t, "ip4", p.Network())
+
+	// No address of the family means an error, and nothing changes
+	addrs = []net.IPAddr{{IP: net.ParseIP("::1")}}
+	AssertError(t, p.SetAddr("v6.example"), "v6.example")
+	AssertEqualStrings(t, "pinger.example", p.Addr())
+	AssertError(t, p.SetNetwork("ip4"), "ip4")
+	AssertEqualStrings(t, "127.0.0.2", p.IPAddr().String())
+
+	// Either family will do for ip
+	AssertNoError(t, p.SetNetwork("ip"))
+	AssertEqualStrings(t, "::1", p.IPAddr().String())
+}
+
+func TestSetResolver(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+
+	var dialed int32
+	dialErr := errors.New("no DNS here")
+	p.SetResolver(&net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			atomic.AddInt32(&dialed, 1)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(100 * time.Millisecond):
+				return nil, dialErr
+			}
+		},
+	})
+
+	// The pinger's resolver is used
+	AssertError(t, p.SetAddr("pinger.example"), "pinger.example")
+	if atomic.LoadInt32(&dialed) == 0 {
+		t.Error("Expected the resolver to be used")
+	}
+	AssertEqualStrings(t, "127.0.0.1", p.IPAddr().String())
+
+	// A cancelled context gives up straight away
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	AssertError(t, p.SetAddrContext(ctx, "pinger.example"), "cancelled")
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Expected the lookup to give up straight away, took %v", elapsed)
+	}
+	AssertEqualStrings(t, "127.0.0.1", p.Addr())
+
+	// IP addresses don't need the resolver
+	AssertNoError(t, p.SetAddrContext(ctx, "::1"))
+	AssertEqualStrings(t, "::1", p.IPAddr().String())
+}
+
+func TestSequenceWraparound(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.Count = 6
+	p.Interval = 5 * time.Millisecond
+
+	// Start just short of where the 16-bit sequence number wraps around, as
+	// if 65533 packets had already been sent
+	p.sequence = 65533
+
+	// Each reply is sent twice, and the duplicates have to be told apart
+	// from the packets after the wraparound too
+	conn := newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		return []*icmp.Message{echoReply(req), echoReply(req)}
+	})
+	p.SetConn(conn)
+
+	var recv []int
+	p.OnRecv = func(pkt *Packet) {
+		recv = append(recv, pkt.Seq)
+	}
+
+	stats, err := p.Run()
+	AssertNoError(t, err)
+	if stats.PacketsRecv != 6 {
+		t.Errorf("Expected %v, got %v", 6, stats.PacketsRecv)
+	}
+	if stats.PacketsRecvDuplicates < 5 {
+		t.Errorf("Expected at least %v duplicates, got %v", 5, stats.PacketsRecvDuplicates)
+	}
+	if stats.PacketsReordered != 0 {
+		t.Errorf("Expected %v reordered, got %v", 0, stats.PacketsReordered)
+	}
+
+	var wire []int
+	for _, m := range conn.Written() {
+		wire = append(wire, m.Body.(*icmp.Echo).Seq)
+	}
+	expectedWire := []int{65533, 65534, 65535, 0, 1, 2}
+	expectedRecv := []int{65533, 65534, 65535, 65536, 65537, 65538}
+	if fmt.Sprint(wire) != fmt.Sprint(expectedWire) {
+		t.Errorf("Expected %v sent, got %v", expectedWire, wire)
+	}
+	if fmt.Sprint(recv) != fmt.Sprint(expectedRecv) {
+		t.Errorf("Expected %v received, got %v", expectedRecv, recv)
+	}
+
+	// A reply from before the wraparound is still recognised as one
+	AssertEqualStrings(t, "65535", fmt.Sprint(p.fullSeq(65535)))
+	AssertEqualStrings(t, "65538", fmt.Sprint(p.fullSeq(2)))
+}
+
+func TestBoundedTracking(t *testing.T) {
+	for _, timeout := range []time.Duration{0, time.Second} {
+		p, err := NewPinger("127.0.0.1")
+		AssertNoError(t, err)
+		p.Timeout = timeout
+
+		// Nothing is ever answered, so sequence numbers either time out or,
+		// without a Timeout, stay outstanding until they leave the window
+		const n = 3 * replyWindow
+		start := time.Now()
+		for i := 0; i < n; i++ {
+			now := start.Add(time.Duration(i) * time.Millisecond)
+			p.sent(timeSliceLength, now)
+			if timeout > 0 && i%100 == 0 {
+				p.expire(now)
+			}
+		}
+
+		if len(p.outstanding) > replyWindow+1 || len(p.expired) > replyWindow+1 {
+			t.Errorf("Expected at most %v tracked with Timeout %v, got %v outstanding and %v expired",
+				replyWindow+1, timeout, len(p.outstanding), len(p.expired))
+		}
+
+		// The oldest sequence number still tracked is the oldest whose
+		// reply can still be matched
+		oldest := n - 1 - replyWindow
+		if _, ok := p.outstanding[oldest]; !ok && timeout == 0 {
+			t.Errorf("Expected icmp_seq=%d to still be outstanding", oldest)
+		}
+		AssertEqualStrings(t, fmt.Sprint(oldest), fmt.Sprint(p.fullSeq(oldest&0xffff)))
+
+		stats := p.finish()
+		if stats.PacketsSent != n || stats.PacketLoss != 100 {
+			t.Errorf("Expected %v sent and all lost, got %v and %v%%",
+				n, stats.PacketsSent, stats.PacketLoss)
+		}
+		lost := stats.Losses[LossNoReply] + stats.Losses[LossTimeout]
+		if lost != n {
+			t.Errorf("Expected %v lost, got %v", n, stats.Losses)
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	SkipUnlessUnprivileged(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	rtt, err := Ping(ctx, "127.0.0.1")
+	AssertNoError(t, err)
+	if rtt <= 0 || rtt > time.Second {
+		t.Errorf("Expected a round-trip time under a second, got %v", rtt)
+	}
+}
+
+func TestPingTimeout(t *testing.T) {
+	SkipUnlessUnprivileged(t)
+
+	// TEST-NET-3 isn't routed anywhere, so nothing will reply
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := Ping(ctx, "203.0.113.1")
+	if err != ErrTimeout {
+		t.Errorf("Expected %v, got %v", ErrTimeout, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected Ping to give up at the deadline, took %v", elapsed)
+	}
+}
+
+func TestPingLongDeadline(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	conn := newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		return []*icmp.Message{echoReply(req)}
+	})
+	conn.writeDelay = 500 * time.Millisecond
+	p.SetConn(conn)
+	p.Count = 1
+
+	// The reply takes longer than the fallback timeout, but arrives well
+	// within the deadline, so it should be waited for
+	p.Interval = 100 * time.Millisecond
+	if timeout, _ := p.fallbackTimeout(); timeout >= conn.writeDelay {
+		t.Fatalf("Expected a fallback timeout under %v, got %v", conn.writeDelay, timeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	rtt, err := p.pingOnce(ctx)
+	AssertNoError(t, err)
+	if rtt < conn.writeDelay {
+		t.Errorf("Expected a round-trip time of at least %v, got %v", conn.writeDelay, rtt)
+	}
+
+	// Without a deadline, the fallback timeout still applies
+	AssertNoError(t, p.Reset())
+	_, err = p.pingOnce(context.Background())
+	if err != ErrTimeout {
+		t.Errorf("Expected %v, got %v", ErrTimeout, err)
+	}
+}
+
+func TestPingResolveError(t *testing.T) {
+	lookupErr := errors.New("no such host")
+	defer stubLookupIPAddr(func(host string) ([]net.IPAddr, error) {
+		return nil, lookupErr
+	})()
+
+	_, err := Ping(context.Background(), "pinger.example")
+	if err != lookupErr {
+		t.Errorf("Expected %v, got %v", lookupErr, err)
+	}
+}
+
+func TestStatisticsRttsCopy(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.rtts = []time.Duration{5, 3, 4, 1, 2}
+
+	stats := p.Statistics()
+	sort.Slice(stats.Rtts, func(i, j int) bool {
+		return stats.Rtts[i] < stats.Rtts[j]
+	})
+	stats.Rtts[0] = 100
+
+	expected := []time.Duration{5, 3, 4, 1, 2}
+	if fmt.Sprint(p.rtts) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, p.rtts)
+	}
+	if again := p.Statistics(); fmt.Sprint(again.Rtts) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, again.Rtts)
+	}
+
+	// With a limit, only the most recent are returned, but the rest of the
+	// statistics still cover them all
+	limited := p.StatisticsWithRtts(2)
+	if fmt.Sprint(limited.Rtts) != fmt.Sprint([]time.Duration{1, 2}) {
+		t.Errorf("Expected %v, got %v", []time.Duration{1, 2}, limited.Rtts)
+	}
+	if limited.MaxRtt != 5 || limited.AvgRtt != 3 || limited.P50Rtt != 3 {
+		t.Errorf("Expected max 5, average 3 and median 3, got %v, %v and %v",
+			limited.MaxRtt, limited.AvgRtt, limited.P50Rtt)
+	}
+	limited.Rtts[0] = 100
+	if p.rtts[3] != 1 {
+		t.Errorf("Expected %v, got %v", 1, p.rtts[3])
+	}
+
+	if all := p.StatisticsWithRtts(0); len(all.Rtts) != 5 {
+		t.Errorf("Expected %v, got %v", 5, len(all.Rtts))
+	}
+	if all := p.StatisticsWithRtts(10); len(all.Rtts) != 5 {
+		t.Errorf("Expected %v, got %v", 5, len(all.Rtts))
+	}
+}
+
+func TestMulticast(t *testing.T) {
+	// Three loopback hosts in the group reply to every request, and the last
+	// of them sends every reply twice.
+	conn := newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		return []*icmp.Message{echoReply(req), echoReply(req), echoReply(req), echoReply(req)}
+	})
+	for _, ip := range []string{"127.0.0.2", "127.0.0.3", "127.0.0.4", "127.0.0.4"} {
+		conn.srcs = append(conn.srcs, &net.IPAddr{IP: net.ParseIP(ip)})
+	}
+
+	p, err := NewPinger("224.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.SetConn(conn)
+	p.Count = 3
+	p.Interval = 10 * time.Millisecond
+
+	var mu sync.Mutex
+	recvs := make(map[string][]int)
+	dups := 0
+	p.OnRecv = func(pkt *Packet) {
+		mu.Lock()
+		defer mu.Unlock()
+		AssertEqualStrings(t, "224.0.0.1", pkt.IPAddr.String())
+		recvs[pkt.Src.String()] = append(recvs[pkt.Src.String()], pkt.Seq)
+	}
+	p.OnDuplicateRecv = func(pkt *Packet) {
+		mu.Lock()
+		defer mu.Unlock()
+		dups++
+	}
+
+	stats, err := p.Run()
+	AssertNoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(recvs) != 3 {
+		t.Fatalf("Expected replies from %v sources, got %v", 3, recvs)
+	}
+	for src, seqs := range recvs {
+		if len(seqs) != 3 {
+			t.Errorf("%s: expected %v replies, got %v", src, 3, seqs)
+		}
+	}
+	if dups != 3 {
+		t.Errorf("Expected %v duplicates, got %v", 3, dups)
+	}
+
+	// The pinger's own statistics count each request once
+	if stats.PacketsSent != 3 || stats.PacketsRecv != 3 || stats.PacketLoss != 0 {
+		t.Errorf("Expected 3 sent and received without loss, got %+v", stats)
+	}
+	if stats.PacketsRecvDuplicates != 3 {
+		t.Errorf("Expected %v duplicates, got %v", 3, stats.PacketsRecvDuplicates)
+	}
+	if len(stats.Rtts) != 3 {
+		t.Errorf("Expected %v rtts, got %v", 3, len(stats.Rtts))
+	}
+
+	if len(stats.Sources) != 3 {
+		t.Fatalf("Expected %v sources, got %v", 3, stats.Sources)
+	}
+	for i, ip := range []string{"127.0.0.2", "127.0.0.3", "127.0.0.4"} {
+		src := stats.Sources[i]
+		AssertEqualStrings(t, ip, src.IPAddr.String())
+		if src.PacketsRecv != 3 || src.PacketLoss != 0 {
+			t.Errorf("%s: expected 3 received without loss, got %+v", ip, src)
+		}
+		if src.MinRtt <= 0 || src.MaxRtt < src.MinRtt {
+			t.Errorf("%s: expected round-trip times, got %+v", ip, src)
+		}
+	}
+	if stats.Sources[0].PacketsRecvDuplicates != 0 || stats.Sources[2].PacketsRecvDuplicates != 3 {
+		t.Errorf("Expected duplicates from only the last source, got %+v", stats.Sources)
+	}
+
+	// A unicast target has no sources
+	p, err = NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.SetConn(newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		return []*icmp.Message{echoReply(req)}
+	}))
+	p.Count = 1
+	stats, err = p.Run()
+	AssertNoError(t, err)
+	if stats.Sources != nil {
+		t.Errorf("Expected no sources, got %v", stats.Sources)
+	}
+}
+
+func TestMulticastNoReply(t *testing.T) {
+	conn := newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		if req.Body.(*icmp.Echo).Seq == 1 {
+			return nil
+		}
+		return []*icmp.Message{echoReply(req)}
+	})
+	conn.srcs = []net.Addr{&net.IPAddr{IP: net.ParseIP("127.0.0.2")}}
+
+	p, err := NewPinger("224.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.SetConn(conn)
+	p.Count = 3
+	p.Interval = 10 * time.Millisecond
+
+	stats, err := p.Run()
+	AssertNoError(t, err)
+	if stats.PacketsSent != 3 || stats.PacketsRecv != 2 {
+		t.Errorf("Expected 3 sent and 2 received, got %+v", stats)
+	}
+	if stats.Losses[LossNoReply] != 1 {
+		t.Errorf("Expected 1 loss with no reply, got %v", stats.Losses)
+	}
+	if len(stats.Sources) != 1 || stats.Sources[0].PacketsRecv != 2 {
+		t.Fatalf("Expected 1 source with 2 replies, got %+v", stats.Sources)
+	}
+	if loss := stats.Sources[0].PacketLoss; math.Abs(loss-100.0/3) > 0.01 {
+		t.Errorf("Expected %v%% loss, got %v", 100.0/3, loss)
+	}
+}
+
+func TestIsBroadcast(t *testing.T) {
+	AssertTrue(t, isBroadcast(net.IPv4bcast))
+	AssertTrue(t, isBroadcast(net.ParseIP("127.255.255.255")))
+	AssertFalse(t, isBroadcast(net.ParseIP("127.0.0.1")))
+	AssertFalse(t, isBroadcast(net.ParseIP("224.0.0.1")))
+	AssertFalse(t, isBroadcast(net.IPv6loopback))
+}
+
+func TestSlowSend(t *testing.T) {
+	// The first send never finishes by itself, but cancelling should still
+	// end the run straight away
+	conn := newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		return []*icmp.Message{echoReply(req)}
+	})
+	conn.writeDelay = time.Hour
+
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.SetConn(conn)
+	p.Count = 3
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	stats, err := p.RunContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the run to be cancelled, took %v", elapsed)
+	}
+	if stats.PacketsSent != 0 {
+		t.Errorf("Expected %v, got %v", 0, stats.PacketsSent)
+	}
+
+	// Stop should work the same way
+	AssertNoError(t, p.Reset())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		p.Stop()
+	}()
+	_, err = p.RunContext(context.Background())
+	AssertNoError(t, err)
+
+	// Sends which are slower than the interval still all get answered
+	AssertNoError(t, p.Reset())
+	conn.writeDelay = 20 * time.Millisecond
+	p.Interval = 5 * time.Millisecond
+	stats, err = p.RunContext(context.Background())
+	AssertNoError(t, err)
+	if stats.PacketsSent != 3 || stats.PacketsRecv != 3 {
+		t.Errorf("Expected 3 sent and received, got %+v", stats)
+	}
+}
+
+func TestPacketIDAndType(t *testing.T) {
+	for _, tc := range []struct {
+		addr      string
+		echo      icmp.Type
+		echoReply icmp.Type
+	}{
+		{"127.0.0.1", ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply},
+		{"::1", ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply},
+	} {
+		p, err := NewPinger(tc.addr)
+		AssertNoError(t, err)
+		p.SetPrivileged(true)
+		AssertNoError(t, p.SetID(0x1234))
+
+		var sent, recv *Packet
+		p.OnSend = func(pkt *Packet) {
+			sent = pkt
+		}
+		p.OnRecv = func(pkt *Packet) {
+			recv = pkt
+		}
+		p.sent(16, time.Now())
+		if sent == nil {
+			t.Fatalf("%s: expected a sent packet", tc.addr)
+		}
+		if sent.Type != tc.echo || sent.ID != 0x1234 {
+			t.Errorf("%s: expected %v with ID %v, got %v with ID %v",
+				tc.addr, tc.echo, 0x1234, sent.Type, sent.ID)
+		}
+
+		reply := marshalMessage(t, &icmp.Message{
+			Type: tc.echoReply,
+			Code: 7,
+			Body: &icmp.Echo{ID: 0x1234, Data: timeToBytes(time.Now())},
+		})
+		AssertNoError(t, p.processPacket(&packet{bytes: reply, nbytes: len(reply)}))
+		if recv == nil {
+			t.Fatalf("%s: expected a reply", tc.addr)
+		}
+		if recv.Type != tc.echoReply || recv.Code != 7 || recv.ID != 0x1234 {
+			t.Errorf("%s: expected %v code %v with ID %v, got %v code %v with ID %v",
+				tc.addr, tc.echoReply, 7, 0x1234, recv.Type, recv.Code, recv.ID)
+		}
+	}
+}
+
+func TestSetClock(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+
+	// Every reply takes exactly 3ms by the clock
+	conn := newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		mu.Lock()
+		now = now.Add(3 * time.Millisecond)
+		mu.Unlock()
+		return []*icmp.Message{echoReply(req)}
+	})
+
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.SetConn(conn)
+	p.SetClock(clock)
+	p.Count = 3
+	p.Interval = 50 * time.Millisecond
+
+	stats, err := p.Run()
+	AssertNoError(t, err)
+	if len(stats.Rtts) != 3 {
+		t.Fatalf("Expected %v rtts, got %v", 3, stats.Rtts)
+	}
+	for _, rtt := range stats.Rtts {
+		if rtt != 3*time.Millisecond {
+			t.Errorf("Expected %v, got %v", 3*time.Millisecond, rtt)
+		}
+	}
+	if stats.StdDevRtt != 0 {
+		t.Errorf("Expected %v, got %v", 0, stats.StdDevRtt)
+	}
+
+	// The timestamp in the payload comes from the clock too
+	sent := conn.Written()[0].Body.(*icmp.Echo)
+	if ts := bytesToTime(sent.Data[:timeSliceLength]); !ts.Equal(now.Add(-9 * time.Millisecond)) {
+		t.Errorf("Expected %v, got %v", now.Add(-9*time.Millisecond), ts)
+	}
+
+	p.SetClock(nil)
+	if time.Since(p.now()) > time.Minute {
+		t.Errorf("Expected the clock to be restored, got %v", p.now())
+	}
+}
+
+func TestUnprivilegedDst(t *testing.T) {
+	p, err := NewPinger("fe80::1%lo")
+	AssertNoError(t, err)
+
+	dst, ok := p.dst(p.IPAddr()).(*net.UDPAddr)
+	if !ok {
+		t.Fatalf("Expected a *net.UDPAddr, got %T", p.dst(p.IPAddr()))
+	}
+	AssertEqualStrings(t, "fe80::1", dst.IP.String())
+	AssertEqualStrings(t, "lo", dst.Zone)
+	if dst.Port != 0 {
+		t.Errorf("Expected %v, got %v", 0, dst.Port)
+	}
+
+	p.SetPrivileged(true)
+	if _, ok := p.dst(p.IPAddr()).(*net.IPAddr); !ok {
+		t.Errorf("Expected a *net.IPAddr, got %T", p.dst(p.IPAddr()))
+	}
+}
+
+func TestUnprivilegedID(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.sent(16, time.Now())
+
+	recvs := 0
+	p.OnRecv = func(pkt *Packet) {
+		recvs++
+	}
+
+	// Where the kernel sets the ID, the reply's won't be ours, but the kernel
+	// has already checked it. Elsewhere, it has to be checked like a raw
+	// socket's.
+	reply := marshalMessage(t, &icmp.Message{
+		Type: ipv4.ICMPTypeEchoReply,
+		Body: &icmp.Echo{ID: (p.ID() + 1) & 0xffff, Data: timeToBytes(time.Now())},
+	})
+	AssertNoError(t, p.processPacket(&packet{bytes: reply, nbytes: len(reply)}))
+	expected := 0
+	if kernelEchoID {
+		expected = 1
+	}
+	if recvs != expected {
+		t.Errorf("Expected %v, got %v", expected, recvs)
+	}
+}
+
+func TestICMPPayload(t *testing.T) {
+	echo := marshalMessage(t, &icmp.Message{
+		Type: ipv4.ICMPTypeEchoReply,
+		Body: &icmp.Echo{ID: 1, Seq: 2, Data: []byte("hello")},
+	})
+	echo6 := marshalMessage(t, &icmp.Message{
+		Type: ipv6.ICMPTypeEchoReply,
+		Body: &icmp.Echo{ID: 1, Seq: 2, Data: []byte("hello")},
+	})
+
+	hdr, err := (&ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + len(echo),
+		TTL:      64,
+		Protocol: protocolICMP,
+		Dst:      net.IPv4(127, 0, 0, 1),
+	}).Marshal()
+	AssertNoError(t, err)
+
+	// An IPv4 header with options
+	opts, err := (&ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen + 4,
+		TotalLen: ipv4.HeaderLen + 4 + len(echo),
+		TTL:      64,
+		Protocol: protocolICMP,
+		Dst:      net.IPv4(127, 0, 0, 1),
+		Options:  []byte{1, 1, 1, 0},
+	}).Marshal()
+	AssertNoError(t, err)
+
+	hdr6 := make([]byte, 40)
+	hdr6[0] = 6 << 4
+	hdr6[4], hdr6[5] = 0, byte(len(echo6))
+	hdr6[6] = protocolIPv6ICMP
+	hdr6[7] = 64
+
+	for _, tc := range []struct {
+		name     string
+		b        []byte
+		ipv4     bool
+		expected []byte
+	}{
+		{"v4 with header", append(append([]byte(nil), hdr...), echo...), true, echo},
+		{"v4 with options", append(append([]byte(nil), opts...), echo...), true, echo},
+		{"v4 without header", echo, true, echo},
+		{"v4 truncated header", hdr[:12], true, hdr[:12]},
+		{"v6 with header", append(append([]byte(nil), hdr6...), echo6...), false, echo6},
+		{"v6 without header", echo6, false, echo6},
+		{"v6 truncated header", hdr6[:20], false, hdr6[:20]},
+	} {
+		got := icmpPayload(tc.b, tc.ipv4)
+		if !bytes.Equal(got, tc.expected) {
+			t.Errorf("%s: expected %x, got %x", tc.name, tc.expected, got)
+		}
+	}
+
+	// Either way, the reply should be parsed with its real round-trip time
+	for _, tc := range []struct {
+		addr string
+		b    []byte
+	}{
+		{"127.0.0.1", hdr},
+		{"::1", hdr6},
+	} {
+		p, err := NewPinger(tc.addr)
+		AssertNoError(t, err)
+		p.SetPrivileged(true)
+		p.sent(16, time.Now().Add(-time.Second))
+
+		typ := icmp.Type(ipv4.ICMPTypeEchoReply)
+		if !p.ipv4 {
+			typ = ipv6.ICMPTypeEchoReply
+		}
+		reply := marshalMessage(t, &icmp.Message{
+			Type: typ,
+			Body: &icmp.Echo{ID: p.ID(), Data: timeToBytes(time.Now())},
+		})
+		b := append(append([]byte(nil), tc.b...), reply...)
+
+		var rtt time.Duration
+		p.OnRecv = func(pkt *Packet) {
+			rtt = pkt.Rtt
+			AssertTrue(t, pkt.Privileged)
+		}
+		AssertNoError(t, p.processPacket(&packet{bytes: b, nbytes: len(b)}))
+		if rtt < time.Second {
+			t.Errorf("%s: expected a round-trip time of at least 1s, got %v", tc.addr, rtt)
+		}
+	}
+}
+
+func TestStopAfterRecv(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.SetConn(newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		return []*icmp.Message{echoReply(req)}
+	}))
+	p.Count = 10
+	p.Interval = 10 * time.Millisecond
+	p.StopAfterRecv = 3
+
+	var finished *Statistics
+	p.OnFinish = func(stats *Statistics) {
+		finished = stats
+	}
+
+	stats, err := p.Run()
+	AssertNoError(t, err)
+	if finished == nil {
+		t.Fatalf("Expected OnFinish to be called")
+	}
+	if stats.PacketsRecv != 3 || stats.PacketsSent != 3 {
+		t.Errorf("Expected 3 sent and received, got %+v", stats)
+	}
+	if finished.PacketsRecv != 3 {
+		t.Errorf("Expected %v, got %v", 3, finished.PacketsRecv)
+	}
+}
+
+func TestStopBelowRtt(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+
+	// The replies get faster by 10ms each time, from 50ms
+	rtt := 60 * time.Millisecond
+	conn := newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		mu.Lock()
+		rtt -= 10 * time.Millisecond
+		now = now.Add(rtt)
+		mu.Unlock()
+		return []*icmp.Message{echoReply(req)}
+	})
+
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.SetConn(conn)
+	p.SetClock(clock)
+	p.Count = 10
+	p.Interval = 10 * time.Millisecond
+	p.StopBelowRtt = 25 * time.Millisecond
+
+	finished := false
+	p.OnFinish = func(*Statistics) {
+		finished = true
+	}
+
+	stats, err := p.Run()
+	AssertNoError(t, err)
+	AssertTrue(t, finished)
+	if stats.PacketsRecv != 4 {
+		t.Errorf("Expected %v, got %v", 4, stats.PacketsRecv)
+	}
+	if stats.MinRtt != 20*time.Millisecond {
+		t.Errorf("Expected %v, got %v", 20*time.Millisecond, stats.MinRtt)
+	}
+}
+
+func TestSetIPAddrChecked(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+
+	// Switching family is fine while there's nothing tied to the old one
+	AssertNoError(t, p.SetIPAddrChecked(&net.IPAddr{IP: net.IPv6loopback}))
+	AssertFalse(t, p.ipv4)
+	AssertEqualStrings(t, "::1", p.Addr())
+
+	AssertNoError(t, p.SetIPAddrChecked(&net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}))
+	AssertTrue(t, p.ipv4)
+
+	// With a source address, it isn't
+	AssertNoError(t, p.SetSource("127.0.0.1"))
+	AssertError(t, p.SetIPAddrChecked(&net.IPAddr{IP: net.IPv6loopback}), "::1")
+	AssertTrue(t, p.ipv4)
+	AssertEqualStrings(t, "127.0.0.1", p.IPAddr().String())
+
+	// A v4-mapped address is still IPv4
+	mapped := &net.IPAddr{IP: net.ParseIP("::ffff:127.0.0.2")}
+	AssertNoError(t, p.SetIPAddrChecked(mapped))
+	AssertTrue(t, p.ipv4)
+	AssertEqualStrings(t, "127.0.0.2", p.IPAddr().String())
+
+	AssertError(t, p.SetIPAddrChecked(&net.IPAddr{IP: net.IP{1, 2, 3}}), "1.2.3")
+	AssertError(t, p.SetIPAddrChecked(nil), "nil")
+	AssertEqualStrings(t, "127.0.0.2", p.IPAddr().String())
+
+	// Nor can the family change mid-run, though the address can
+	AssertNoError(t, p.SetSource(""))
+	p.SetPrivileged(true)
+	p.SetConn(newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		return []*icmp.Message{echoReply(req)}
+	}))
+	p.Count = 1
+	var errs []error
+	p.OnSend = func(pkt *Packet) {
+		errs = append(errs,
+			p.SetIPAddrChecked(&net.IPAddr{IP: net.IPv6loopback}),
+			p.SetIPAddrChecked(&net.IPAddr{IP: net.IPv4(127, 0, 0, 3)}))
+	}
+	_, err = p.Run()
+	AssertNoError(t, err)
+	if len(errs) != 2 {
+		t.Fatalf("Expected %v errors, got %v", 2, errs)
+	}
+	AssertError(t, errs[0], "::1")
+	AssertNoError(t, errs[1])
+	AssertEqualStrings(t, "127.0.0.3", p.IPAddr().String())
+}
+
+func TestOnStats(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.SetConn(newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		return []*icmp.Message{echoReply(req)}
+	}))
+	p.Interval = 15 * time.Millisecond
+	p.Deadline = 500 * time.Millisecond
+	p.StatsInterval = 50 * time.Millisecond
+
+	var snapshots []*Statistics
+	finished := false
+	p.OnStats = func(stats *Statistics) {
+		if finished {
+			t.Errorf("Expected no statistics after OnFinish")
+		}
+		snapshots = append(snapshots, stats)
+	}
+	p.OnFinish = func(*Statistics) {
+		finished = true
+	}
+
+	_, err = p.Run()
+	AssertNoError(t, err)
+
+	// About 10 over the run, allowing for slow timers
+	if len(snapshots) < 6 || len(snapshots) > 10 {
+		t.Errorf("Expected about %v snapshots, got %v", 10, len(snapshots))
+	}
+	for i := 1; i < len(snapshots); i++ {
+		if snapshots[i].PacketsSent < snapshots[i-1].PacketsSent {
+			t.Errorf("Expected the snapshots to count up, got %v after %v",
+				snapshots[i].PacketsSent, snapshots[i-1].PacketsSent)
+		}
+	}
+	if n := len(snapshots); n > 0 && snapshots[n-1].PacketsRecv == 0 {
+		t.Errorf("Expected replies in the last snapshot")
+	}
+
+	// It's the pinger's own snapshot, which later ones don't change
+	if n := len(snapshots); n > 1 && snapshots[0] == snapshots[n-1] {
+		t.Errorf("Expected a fresh snapshot each time")
+	}
+}
+
+func TestOnlyOnFinish(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.SetConn(newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		return []*icmp.Message{echoReply(req)}
+	}))
+	p.Count = 3
+	p.Interval = time.Millisecond
+
+	// Like ping -q, nothing but OnFinish is set, and the replies should
+	// still make it into the summary
+	var finished []*Statistics
+	p.OnFinish = func(stats *Statistics) {
+		finished = append(finished, stats)
+	}
+	_, err = p.Run()
+	AssertNoError(t, err)
+
+	if len(finished) != 1 {
+		t.Fatalf("Expected OnFinish to be called %v times, got %v", 1, len(finished))
+	}
+	stats := finished[0]
+	if stats.PacketsSent != 3 || stats.PacketsRecv != 3 {
+		t.Errorf("Expected 3 sent and received, got %v and %v",
+			stats.PacketsSent, stats.PacketsRecv)
+	}
+	if stats.PacketLoss != 0 {
+		t.Errorf("Expected %v, got %v", 0.0, stats.PacketLoss)
+	}
+	if len(stats.Rtts) != 3 {
+		t.Errorf("Expected %v rtts, got %v", 3, len(stats.Rtts))
+	}
+	if stats.MinRtt <= 0 || stats.MaxRtt < stats.MinRtt {
+		t.Errorf("Expected a positive round-trip time summary, got min %v and max %v",
+			stats.MinRtt, stats.MaxRtt)
+	}
+}
+
+// Test helpers
+func SkipUnlessPrivileged(t *testing.T) {
+	conn, err := icmp.ListenPacket("ip4:icmp", "")
+	if err != nil {
+		t.Skipf("Privileged ICMP sockets unavailable: %s", err)
+	}
+	conn.Close()
+}
+
+func SkipUnlessUnprivileged(t *testing.T) {
+	conn, err := icmp.ListenPacket("udp4", "")
+	if err != nil {
+		t.Skipf("Unprivileged ICMP sockets unavailable: %s", err)
+	}
+	conn.Close()
+}
+
+func marshalMessage(t *testing.T, m *icmp.Message) []byte {
+	b, err := m.Marshal(nil)
+	if err != nil {
+		t.Fatalf("Failed to marshal message: %s", err)
+	}
+	return b
+}
+
+func AssertNoError(t *testing.T, err error) {
+	if err != nil {
+		t.Errorf("Expected No Error but got %s, Stack:\n%s",
+			err, string(debug.Stack()))
+	}
+}
+
+func AssertError(t *testing.T, err error, info string) {
+	if err == nil {
+		t.Errorf("Expected Error but got %s, %s, Stack:\n%s",
+			err, info, string(debug.Stack()))
+	}
+}
+
+func AssertEqualStrings(t *testing.T, expected, actual string) {
+	if expected != actual {
+		t.Errorf("Expected %s, got %s, Stack:\n%s",
+			expected, actual, string(debug.Stack()))
+	}
+}
+
+func AssertNotEqualStrings(t *testing.T, expected, actual string) {
+	if expected == actual {
+		t.Errorf("Expected %s, got %s, Stack:\n%s",
+			expected, actual, string(debug.Stack()))
+	}
+}
+
+func AssertTrue(t *testing.T, b bool) {
+	if !b {
+		t.Errorf("Expected True, got False, Stack:\n%s", string(debug.Stack()))
+	}
+}
+
+func AssertFalse(t *testing.T, b bool) {
+	if b {
+		t.Errorf("Expected False, got True, Stack:\n%s", string(debug.Stack()))
+	}
+}
+
+// fakeConn is an in-memory Conn for IPv4. Each echo request written to it is
+// passed to reply, and the messages reply returns are read back from it as if
+// they were sent by the request's destination.
+type fakeConn struct {
+	reply func(req *icmp.Message) []*icmp.Message
+	in    chan fakePacket
+
+	// src, if set, is the address replies come from, instead of the address
+	// they were sent to.
+	src net.Addr
+
+	// srcs, if set, is the address each of the replies to a request comes
+	// from in turn, as if they were sent by different hosts.
+	srcs []net.Addr
+
+	// writeErr, if set, is called with the number of writes before each one,
+	// and the write fails with the errno it returns, if any.
+	writeErr func(n int) syscall.Errno
+
+	// writeDelay, if set, is how long each write blocks for, unless a write
+	// deadline which has already passed interrupts it.
+	writeDelay time.Duration
+
+	mu            sync.Mutex
+	writes        int
+	written       []*icmp.Message
+	dsts          []net.Addr
+	deadline      time.Time
+	writeDeadline time.Time
+	wake          chan struct{}
+}
+
+type fakePacket struct {
+	b    []byte
+	addr net.Addr
+}
+
+type fakeTimeout struct{}
+
+func (fakeTimeout) Error() string   { return "i/o timeout" }
+func (fakeTimeout) Timeout() bool   { return true }
+func (fakeTimeout) Temporary() bool { return true }
+
+func newFakeConn(reply func(req *icmp.Message) []*icmp.Message) *fakeConn {
+	return &fakeConn{
+		reply: reply,
+		in:    make(chan fakePacket, 100),
+		wake:  make(chan struct{}),
+	}
+}
+
+func (c *fakeConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline, wake := c.deadline, c.wake
+		c.mu.Unlock()
+
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, &net.OpError{Op: "read", Net: "fake", Err: fakeTimeout{}}
+			}
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+			expired = timer.C
+		}
+
+		select {
+		case pkt := <-c.in:
+			return copy(b, pkt.b), pkt.addr, nil
+		case <-wake:
+		case <-expired:
+		}
+	}
+}
+
+func (c *fakeConn) WriteTo(b []byte, dst net.Addr) (int, error) {
+	m, err := icmp.ParseMessage(protocolICMP, b)
+	if err != nil {
+		return 0, err
+	}
+
+	if c.writeDelay > 0 {
+		delay := time.NewTimer(c.writeDelay)
+		defer delay.Stop()
+		for waiting := true; waiting; {
+			c.mu.Lock()
+			deadline, wake := c.writeDeadline, c.wake
+			c.mu.Unlock()
+			if !deadline.IsZero() && !time.Now().Before(deadline) {
+				return 0, &net.OpError{Op: "write", Net: "fake", Err: fakeTimeout{}}
+			}
+
+			select {
+			case <-delay.C:
+				waiting = false
+			case <-wake:
+			}
+		}
+	}
+
+	c.mu.Lock()
+	n := c.writes
+	c.writes++
+	c.mu.Unlock()
+	if c.writeErr != nil {
+		if errno := c.writeErr(n); errno != 0 {
+			return 0, &net.OpError{Op: "write", Net: "fake", Err: os.NewSyscallError("sendto", errno)}
+		}
+	}
+
+	c.mu.Lock()
+	c.written = append(c.written, m)
+	c.dsts = append(c.dsts, dst)
+	c.mu.Unlock()
+
+	for i, reply := range c.reply(m) {
+		rb, err := reply.Marshal(nil)
+		if err != nil {
+			return 0, err
+		}
+		src := dst
+		if c.src != nil {
+			src = c.src
+		}
+		if i < len(c.srcs) {
+			src = c.srcs[i]
+		}
+		c.in <- fakePacket{b: rb, addr: src}
+	}
+	return len(b), nil
+}
+
+func (c *fakeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deadline = t
+	close(c.wake)
+	c.wake = make(chan struct{})
+	return nil
+}
+
+func (c *fakeConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeDeadline = t
+	close(c.wake)
+	c.wake = make(chan struct{})
+	return nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+// Written returns every message written to the conn.
+func (c *fakeConn) Written() []*icmp.Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]*icmp.Message(nil), c.written...)
+}
+
+// echoReply returns the reply to the echo request req.
+func echoReply(req *icmp.Message) *icmp.Message {
+	echo := *req.Body.(*icmp.Echo)
+	echo.Data = append([]byte(nil), echo.Data...)
+	return &icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &echo}
+}
+
+// benchConn is a Conn which has a copy of reply to read whenever it's read
+// from, for benchmarking the receive path.
+type benchConn struct {
+	reply []byte
+	addr  net.Addr
+}
+
+func (c *benchConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return copy(b, c.reply), c.addr, nil
+}
+
+func (c *benchConn) WriteTo(b []byte, dst net.Addr) (int, error) { return len(b), nil }
+func (c *benchConn) SetReadDeadline(t time.Time) error           { return nil }
+func (c *benchConn) Close() error                                { return nil }
+
+// stubLookupIPAddr replaces how pingers look up addresses with lookup, and
+// returns a function which restores it.
+func stubLookupIPAddr(lookup func(host string) ([]net.IPAddr, error)) func() {
+	orig := lookupIPAddr
+	lookupIPAddr = func(ctx context.Context, r *net.Resolver, host string) ([]net.IPAddr, error) {
+		return lookup(host)
+	}
+	return func() {
+		lookupIPAddr = orig
 	}
 }
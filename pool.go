@@ -0,0 +1,571 @@
+package ping
+
+import (
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Pool pings many targets at once. Rather than giving each target its own
+// socket, goroutines and ticker, a Pool shares one socket per address family
+// between all of its targets and spreads its sends across them round-robin at
+// a fixed aggregate rate. This keeps the send rate steady when monitoring
+// thousands of hosts, where independent Pingers would tend to send in bursts.
+//
+// Each target keeps its own ICMP ID. In privileged mode, replies are matched to
+// targets by that ID. In unprivileged mode on Linux the kernel assigns a single
+// ID to the shared socket, so replies are matched by their source address
+// instead.
+//
+// Otherwise each target is run much as it would be on its own: its Timeout,
+// callbacks and statistics are its own, and OnFinish is called for it when the
+// pool finishes. If sending to a target fails in a way retrying won't fix, the
+// pool gives up on that target and carries on with the rest. See Target.
+type Pool struct {
+	// Rate is the total number of echo packets sent per second across all
+	// targets in the pool. Each target is pinged once every len(targets)/Rate
+	// seconds. Default is 100.
+	Rate int
+
+	// Count tells the pool to stop after sending Count echo packets to each
+	// target, once every one of them has been answered or, for targets with a
+	// Timeout, has timed out. If this option is not specified, the pool will
+	// operate until interrupted.
+	Count int
+
+	// OnRecv is called when the pool receives and processes a packet from any
+	// of its targets, after the target's own OnRecv.
+	OnRecv func(*Packet)
+
+	targets []*Pinger
+	byAddr  map[string]*Pinger
+	byIP    map[string]*Pinger
+	byID    map[int]*Pinger
+
+	// next is the index of the target which will be sent the next packet.
+	next int
+
+	// sent is the number of packets sent by the pool in the current run, and
+	// attempts is the number each target has been sent, including any which
+	// failed and weren't counted in its statistics.
+	sent     int
+	attempts map[*Pinger]int
+
+	// failed is the set of targets the pool has given up sending to, because
+	// sending to them failed in a way retrying won't fix.
+	failed map[*Pinger]bool
+
+	// finished is the number of targets which are done with Count packets,
+	// and done is the set of them.
+	finished int
+	done     map[*Pinger]bool
+
+	network string
+
+	// conn, if set, is used for every target instead of opening sockets.
+	conn Conn
+}
+
+// NewPool returns a new, empty Pool struct pointer.
+func NewPool() *Pool {
+	return &Pool{
+		Rate:  100,
+		Count: -1,
+
+		byAddr:  make(map[string]*Pinger),
+		byIP:    make(map[string]*Pinger),
+		byID:    make(map[int]*Pinger),
+		network: "udp",
+	}
+}
+
+// Add resolves addr and adds it to the pool's targets. Like SetAddr, addr can
+// be a DNS name or an IP. Replies are matched to targets by their source
+// address, so addr must not resolve to the same IP as an existing target.
+func (p *Pool) Add(addr string) error {
+	if _, ok := p.byAddr[addr]; ok {
+		return fmt.Errorf("%s is already in the pool", addr)
+	}
+
+	target, err := NewPinger(addr)
+	if err != nil {
+		return err
+	}
+
+	key := ipKey(target.ipaddr.IP)
+	if _, ok := p.byIP[key]; ok {
+		return fmt.Errorf("%s resolves to %s which is already in the pool",
+			addr, target.ipaddr)
+	}
+
+	// IDs only repeat once 65536 pingers have been created, but a pool that
+	// size could still see a collision.
+	for i := 0; i <= 0xffff && p.byID[target.id] != nil; i++ {
+		target.id = newID()
+	}
+	if p.byID[target.id] != nil {
+		return fmt.Errorf("No ICMP IDs left for %s", addr)
+	}
+
+	p.targets = append(p.targets, target)
+	p.byAddr[addr] = target
+	p.byIP[key] = target
+	p.byID[target.id] = target
+	return nil
+}
+
+// Statistics returns the statistics of the target which was added as addr, or
+// nil if there is no such target. Like Pinger.Statistics, this can be run
+// while the pool is running or after it is finished.
+func (p *Pool) Statistics(addr string) *Statistics {
+	target, ok := p.byAddr[addr]
+	if !ok {
+		return nil
+	}
+	return target.Statistics()
+}
+
+// Target returns the Pinger for the target which was added as addr, or nil if
+// there is no such target, so its Timeout, callbacks and payload can be
+// changed before the pool runs. The pool decides when it sends, so its
+// Interval, Count and Flood aren't used. Calling its Stop stops the whole
+// pool, and RunContext returns without an error.
+//
+// Targets of the same address family share a socket, so their socket settings
+// (source, interface, TTL, traffic class, Don't Fragment and mark) have to be
+// the same. If they aren't, the pool returns an error when it's run.
+func (p *Pool) Target(addr string) *Pinger {
+	return p.byAddr[addr]
+}
+
+// SetPrivileged sets the type of ping the pool will send. See
+// Pinger.SetPrivileged for details.
+func (p *Pool) SetPrivileged(privileged bool) {
+	if privileged {
+		p.network = "ip"
+	} else {
+		p.network = "udp"
+	}
+}
+
+// Privileged returns whether the pool is running in privileged mode.
+func (p *Pool) Privileged() bool {
+	return p.network == "ip"
+}
+
+// Run runs the pool. This is a blocking function that will exit when it's
+// done. If Count is not specified, it will run continuously until it is
+// interrupted. If Count is specified and the pool doesn't finish in time, it
+// returns ErrTimeout.
+func (p *Pool) Run() error {
+	// Our fallback timeout is the time it takes to send to every target, times
+	// the count plus two (if the count isn't 0), plus the longest of their
+	// Timeouts. If that would overflow, we go without one, as Pinger does.
+	var timeout time.Duration
+	if p.Count > 0 && p.Rate > 0 {
+		var wait time.Duration
+		for _, target := range p.targets {
+			if target.Timeout > wait {
+				wait = target.Timeout
+			}
+		}
+
+		round := time.Second * time.Duration(len(p.targets)) / time.Duration(p.Rate)
+		n := int64(p.Count) + 2
+		if round <= 0 || n <= int64(maxDuration-wait)/int64(round) {
+			timeout = round*time.Duration(n) + wait
+		}
+	}
+
+	return p.runContext(context.Background(), timeout)
+}
+
+// RunContext runs the pool with the given context. This is a blocking function
+// that will exit when it's done. If Count is not specified, it will run
+// continuously until it is interrupted. The context passed in can be used for
+// cancellation. If it's done before the pool finishes, its error is returned.
+// If sending fails in a way retrying won't fix for every one of the targets,
+// the last of those errors is returned.
+func (p *Pool) RunContext(ctx context.Context) error {
+	return p.runContext(ctx, 0)
+}
+
+// runContext implements Run and RunContext. If timeout isn't 0, the run gives
+// up with ErrTimeout after that long.
+func (p *Pool) runContext(ctx context.Context, timeout time.Duration) error {
+	if len(p.targets) == 0 {
+		return errors.New("No targets in pool")
+	}
+	if p.Rate <= 0 {
+		return fmt.Errorf("Invalid pool rate: %d", p.Rate)
+	}
+
+	var pc4, pc6 *icmp.PacketConn
+	var first4, first6 *Pinger
+	var err error
+	for _, target := range p.targets {
+		target.network = p.network
+
+		first := &first6
+		if target.ipv4 {
+			first = &first4
+		}
+		if *first == nil {
+			*first = target
+		} else if !sameSocketSettings(*first, target) {
+			return fmt.Errorf("%s has different socket settings to %s, which it shares a socket with",
+				target.addr, (*first).addr)
+		}
+		if p.conn != nil {
+			continue
+		}
+
+		if target.ipv4 && pc4 == nil {
+			if pc4, err = target.listen(ipv4Proto[p.network], target.source); err != nil {
+				return err
+			}
+			defer pc4.Close()
+			if err = target.setSocketOptions(pc4); err != nil {
+				return err
+			}
+		} else if !target.ipv4 && pc6 == nil {
+			if pc6, err = target.listen(ipv6Proto[p.network], target.source); err != nil {
+				return err
+			}
+			defer pc6.Close()
+			if err = target.setSocketOptions(pc6); err != nil {
+				return err
+			}
+		}
+	}
+
+	var conn4, conn6 Conn
+	var conns []Conn
+	if p.conn != nil {
+		conn4, conn6 = p.conn, p.conn
+		conns = append(conns, p.conn)
+	}
+	if pc4 != nil {
+		conn4 = pc4
+		conns = append(conns, pc4)
+	}
+	if pc6 != nil {
+		conn6 = pc6
+		conns = append(conns, pc6)
+	}
+
+	// Each target is run as it would be by itself, so the ones which are
+	// still outstanding at the end are counted as lost and OnFinish is
+	// called. The pool's OnRecv goes through the run's hook, so the target's
+	// own is left alone.
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	hook := func(e Event) {
+		if handler := p.OnRecv; e.Type == EventRecv && handler != nil {
+			handler(e.Packet)
+		}
+	}
+	for _, target := range p.targets {
+		target.startRun(stop, hook)
+	}
+	defer func() {
+		for _, target := range p.targets {
+			target.finish()
+			target.endRun()
+		}
+	}()
+
+	wg := &sync.WaitGroup{}
+	innerCtx, cancel := context.WithCancel(ctx)
+	defer stopRecv(cancel, wg, conns...)
+
+	size := 0
+	for _, target := range p.targets {
+		if n := target.recvBufferSize(); n > size {
+			size = n
+		}
+	}
+
+	recv := make(chan *packet, 5)
+	for _, conn := range conns {
+		wg.Add(1)
+		go recvICMP(innerCtx, conn, size, recv, wg)
+	}
+
+	p.next = 0
+	p.sent = 0
+	p.finished = 0
+	p.done = make(map[*Pinger]bool)
+	p.attempts = make(map[*Pinger]int)
+	p.failed = make(map[*Pinger]bool)
+
+	// Sends are driven by a token bucket rather than one tick per packet, so
+	// high rates don't depend on sub-millisecond ticker precision.
+	tick := time.Second / time.Duration(p.Rate)
+	if tick < time.Millisecond {
+		tick = time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	var fallback <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		fallback = timer.C
+	}
+
+	// Targets with a Timeout are queued to be expired once it's up after each
+	// send, and the timeout timer is set for the first of them.
+	var expiries expiryQueue
+	var timeouts <-chan time.Time
+	var timeoutTimer *time.Timer
+	defer func() {
+		if timeoutTimer != nil {
+			timeoutTimer.Stop()
+		}
+	}()
+	resetTimeouts := func() {
+		if timeoutTimer != nil && !timeoutTimer.Stop() {
+			select {
+			case <-timeoutTimer.C:
+			default:
+			}
+		}
+		if len(expiries) == 0 {
+			timeouts = nil
+			return
+		}
+		d := time.Until(expiries[0].at)
+		if timeoutTimer == nil {
+			timeoutTimer = time.NewTimer(d)
+		} else {
+			timeoutTimer.Reset(d)
+		}
+		timeouts = timeoutTimer.C
+	}
+
+	start := time.Now()
+	send := func() error {
+		budget := int(time.Since(start).Seconds()*float64(p.Rate)) + 1 - p.sent
+		for ; budget > 0; budget-- {
+			target := p.nextTarget()
+			if target == nil {
+				return nil
+			}
+
+			conn := conn6
+			if target.ipv4 {
+				conn = conn4
+			}
+			if err := target.sendICMP(conn); err != nil {
+				// Like a target which doesn't reply, one which can't be sent
+				// to shouldn't hold up the others.
+				target.printf("Error sending to %s, giving up on it: %s", target.addr, err)
+				p.failed[target] = true
+				if len(p.failed) == len(p.targets) {
+					return err
+				}
+			}
+
+			// A send which failed isn't retried, so that may have been the
+			// target's last chance.
+			p.checkFinished(target)
+			if target.Timeout > 0 {
+				heap.Push(&expiries, expiry{target: target, at: time.Now().Add(target.Timeout)})
+				if expiries[0].target == target {
+					resetTimeouts()
+				}
+			}
+		}
+		return nil
+	}
+
+	if err = send(); err != nil {
+		return err
+	}
+	if p.Count > 0 && p.finished >= len(p.targets) {
+		cancel()
+		return nil
+	}
+
+	for {
+		select {
+		case <-innerCtx.Done():
+			if p.stopping() {
+				return nil
+			}
+			return ctx.Err()
+		case <-fallback:
+			return ErrTimeout
+		case <-ticker.C:
+			if err = send(); err != nil {
+				return err
+			}
+			if p.Count > 0 && p.finished >= len(p.targets) {
+				cancel()
+				return nil
+			}
+		case <-timeouts:
+			timeouts = nil
+			now := time.Now()
+			for len(expiries) > 0 && !expiries[0].at.After(now) {
+				target := heap.Pop(&expiries).(expiry).target
+				target.expire(target.now())
+				p.checkFinished(target)
+			}
+			resetTimeouts()
+
+			if p.Count > 0 && p.finished >= len(p.targets) {
+				cancel()
+				return nil
+			}
+		case r := <-recv:
+			p.processPacket(r)
+
+			if p.Count > 0 && p.finished >= len(p.targets) {
+				cancel()
+				return nil
+			}
+		}
+	}
+}
+
+// nextTarget returns the next target to send a packet to, or nil if every
+// target has already been sent Count packets or been given up on.
+func (p *Pool) nextTarget() *Pinger {
+	for range p.targets {
+		target := p.targets[p.next]
+		p.next = (p.next + 1) % len(p.targets)
+		if p.failed[target] || (p.Count > 0 && p.attempts[target] >= p.Count) {
+			continue
+		}
+
+		p.sent++
+		if p.attempts == nil {
+			p.attempts = make(map[*Pinger]int)
+		}
+		p.attempts[target]++
+		return target
+	}
+	return nil
+}
+
+// sameSocketSettings returns whether a and b can share a socket.
+func sameSocketSettings(a, b *Pinger) bool {
+	return a.source == b.source && a.iface == b.iface && a.ttl == b.ttl &&
+		a.tc == b.tc && a.df == b.df && a.mark == b.mark
+}
+
+// processPacket hands a received packet to the target it came from.
+func (p *Pool) processPacket(recv *packet) {
+	target := p.lookup(recv)
+	if target == nil {
+		// Not from one of our targets, ignore it
+		recv.release()
+		return
+	}
+
+	// Errors are deliberately dropped here. A single misbehaving target
+	// shouldn't be able to stop the whole pool.
+	_ = target.processPacket(recv)
+	p.checkFinished(target)
+}
+
+// stopping returns whether Stop has been called on any of the targets during
+// the current run.
+func (p *Pool) stopping() bool {
+	for _, target := range p.targets {
+		if target.stopping() {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFinished counts target as finished if it has received Count packets, the
+// pool has tried to send it them all and none are still outstanding, or the
+// pool has given up on it. Sends which failed aren't counted in PacketsSent,
+// but aren't tried again either.
+func (p *Pool) checkFinished(target *Pinger) {
+	if p.Count <= 0 || p.done[target] {
+		return
+	}
+
+	target.mu.Lock()
+	idle := p.attempts[target] >= p.Count && len(target.outstanding) == 0
+	target.mu.Unlock()
+	if target.PacketsRecv >= p.Count || idle || p.failed[target] {
+		if p.done == nil {
+			p.done = make(map[*Pinger]bool)
+		}
+		p.done[target] = true
+		p.finished++
+	}
+}
+
+// expiry is when a target's oldest outstanding packet might time out.
+type expiry struct {
+	target *Pinger
+	at     time.Time
+}
+
+// expiryQueue is a heap of expiries, soonest first.
+type expiryQueue []expiry
+
+func (q expiryQueue) Len() int            { return len(q) }
+func (q expiryQueue) Less(i, j int) bool  { return q[i].at.Before(q[j].at) }
+func (q expiryQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *expiryQueue) Push(x interface{}) { *q = append(*q, x.(expiry)) }
+
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+// lookup finds the target a received packet belongs to: by the ID of the echo
+// reply where the IDs are the targets' own, falling back to its source address
+// for other messages and in unprivileged mode on Linux.
+func (p *Pool) lookup(recv *packet) *Pinger {
+	ipaddr := ipAddrOf(recv.addr)
+	if p.network != "udp" || !kernelEchoID {
+		v4 := ipaddr == nil || isIPv4(ipaddr.IP)
+		if id, ok := echoReplyID(recv.bytes[:recv.nbytes], v4); ok {
+			return p.byID[id]
+		}
+	}
+
+	if ipaddr == nil {
+		return nil
+	}
+	return p.byIP[ipKey(ipaddr.IP)]
+}
+
+// echoReplyID returns the ID of the ICMP or ICMPv6 echo reply in b, which may
+// start with an IP header, read from an IPv4 socket if v4 is set. It doesn't
+// fully parse the message, since every target will do that itself.
+func echoReplyID(b []byte, v4 bool) (int, bool) {
+	b = icmpPayload(b, v4)
+	if len(b) < 8 {
+		return 0, false
+	}
+	if b[0] != byte(ipv4.ICMPTypeEchoReply) && b[0] != byte(ipv6.ICMPTypeEchoReply) {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint16(b[4:6])), true
+}
+
+func ipKey(ip net.IP) string {
+	return string(ip.To16())
+}
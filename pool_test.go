@@ -0,0 +1,336 @@
+package ping
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func TestPoolAdd(t *testing.T) {
+	p := NewPool()
+	AssertNoError(t, p.Add("127.0.0.1"))
+	AssertNoError(t, p.Add("127.0.0.2"))
+
+	// Adding the same target twice should fail
+	err := p.Add("127.0.0.1")
+	AssertError(t, err, "127.0.0.1")
+
+	// So should adding a different name for the same address
+	err = p.Add("::ffff:127.0.0.2")
+	AssertError(t, err, "::ffff:127.0.0.2")
+
+	err = p.Add("127.0.0.0.1")
+	AssertError(t, err, "127.0.0.0.1")
+
+	if p.Statistics("127.0.0.1") == nil {
+		t.Errorf("Expected statistics for 127.0.0.1")
+	}
+	if p.Statistics("127.0.0.3") != nil {
+		t.Errorf("Expected no statistics for 127.0.0.3")
+	}
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	p := NewPool()
+	p.Count = 2
+	for i := 1; i <= 3; i++ {
+		AssertNoError(t, p.Add(fmt.Sprintf("127.0.0.%d", i)))
+	}
+
+	var order []string
+	for target := p.nextTarget(); target != nil; target = p.nextTarget() {
+		order = append(order, target.Addr())
+	}
+
+	expected := []string{
+		"127.0.0.1", "127.0.0.2", "127.0.0.3",
+		"127.0.0.1", "127.0.0.2", "127.0.0.3",
+	}
+	if len(order) != len(expected) {
+		t.Fatalf("Expected %v sends, got %v", len(expected), len(order))
+	}
+	for i := range expected {
+		AssertEqualStrings(t, expected[i], order[i])
+	}
+}
+
+func TestPoolProcessPacket(t *testing.T) {
+	p := NewPool()
+	p.Count = 1
+	AssertNoError(t, p.Add("127.0.0.1"))
+	AssertNoError(t, p.Add("127.0.0.2"))
+
+	reply := poolReply(t, net.IPv4(127, 0, 0, 2))
+	p.processPacket(reply)
+
+	// Replies from addresses outside the pool should be ignored
+	p.processPacket(poolReply(t, net.IPv4(127, 0, 0, 3)))
+
+	if stats := p.Statistics("127.0.0.1"); stats.PacketsRecv != 0 {
+		t.Errorf("Expected %v, got %v", 0, stats.PacketsRecv)
+	}
+	if stats := p.Statistics("127.0.0.2"); stats.PacketsRecv != 1 {
+		t.Errorf("Expected %v, got %v", 1, stats.PacketsRecv)
+	}
+	if p.finished != 1 {
+		t.Errorf("Expected %v, got %v", 1, p.finished)
+	}
+}
+
+func TestPoolProcessPacketByID(t *testing.T) {
+	p := NewPool()
+	p.SetPrivileged(true)
+	AssertNoError(t, p.Add("127.0.0.1"))
+	AssertNoError(t, p.Add("127.0.0.2"))
+
+	one, two := p.byAddr["127.0.0.1"], p.byAddr["127.0.0.2"]
+	if one.id == two.id {
+		t.Fatalf("Expected targets to have different IDs, both have %v", one.id)
+	}
+
+	// In privileged mode the ID decides the target, whatever the source
+	reply := poolReply(t, net.IPv4(127, 0, 0, 1))
+	reply.bytes = marshalMessage(t, &icmp.Message{
+		Type: ipv4.ICMPTypeEchoReply,
+		Body: &icmp.Echo{ID: two.id, Data: timeToBytes(time.Now())},
+	})
+	reply.nbytes = len(reply.bytes)
+	p.processPacket(reply)
+
+	// And replies with an ID outside the pool are ignored
+	other := 0
+	for other == one.id || other == two.id {
+		other++
+	}
+	reply.bytes = marshalMessage(t, &icmp.Message{
+		Type: ipv4.ICMPTypeEchoReply,
+		Body: &icmp.Echo{ID: other, Data: timeToBytes(time.Now())},
+	})
+	reply.nbytes = len(reply.bytes)
+	p.processPacket(reply)
+
+	if stats := p.Statistics("127.0.0.1"); stats.PacketsRecv != 0 {
+		t.Errorf("Expected %v, got %v", 0, stats.PacketsRecv)
+	}
+	if stats := p.Statistics("127.0.0.2"); stats.PacketsRecv != 1 {
+		t.Errorf("Expected %v, got %v", 1, stats.PacketsRecv)
+	}
+}
+
+func TestPoolRun(t *testing.T) {
+	SkipUnlessPrivileged(t)
+
+	p := NewPool()
+	p.SetPrivileged(true)
+	p.Count = 3
+	addrs := []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"}
+	for _, addr := range addrs {
+		AssertNoError(t, p.Add(addr))
+	}
+
+	AssertNoError(t, p.Run())
+	for _, addr := range addrs {
+		stats := p.Statistics(addr)
+		if stats.PacketsSent != 3 || stats.PacketsRecv != 3 {
+			t.Errorf("%s: expected 3 sent and received, got %v and %v",
+				addr, stats.PacketsSent, stats.PacketsRecv)
+		}
+	}
+}
+
+func TestPoolTimeout(t *testing.T) {
+	p := NewPool()
+	p.SetPrivileged(true)
+	p.Count = 3
+	AssertNoError(t, p.Add("127.0.0.1"))
+	AssertNoError(t, p.Add("127.0.0.2"))
+
+	// The last packet to 127.0.0.2 is lost
+	lossy := p.Target("127.0.0.2")
+	p.conn = newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		if echo := req.Body.(*icmp.Echo); echo.ID == lossy.id && echo.Seq == 2 {
+			return nil
+		}
+		return []*icmp.Message{echoReply(req)}
+	})
+	lossy.Timeout = 50 * time.Millisecond
+
+	var timeouts []int
+	lossy.OnTimeout = func(seq int) {
+		timeouts = append(timeouts, seq)
+	}
+	targetRecvs, poolRecvs, finished := 0, 0, 0
+	p.Target("127.0.0.1").OnRecv = func(*Packet) {
+		targetRecvs++
+	}
+	p.OnRecv = func(*Packet) {
+		poolRecvs++
+	}
+	for _, addr := range []string{"127.0.0.1", "127.0.0.2"} {
+		p.Target(addr).OnFinish = func(*Statistics) {
+			finished++
+		}
+	}
+
+	// The run finishes once the lost packet times out, rather than giving up
+	AssertNoError(t, p.Run())
+
+	stats := p.Statistics("127.0.0.2")
+	if stats.PacketsSent != 3 || stats.PacketsRecv != 2 || stats.Losses[LossTimeout] != 1 {
+		t.Errorf("Expected 3 sent, 2 received and 1 timed out, got %v, %v and %v",
+			stats.PacketsSent, stats.PacketsRecv, stats.Losses)
+	}
+	if len(timeouts) != 1 || timeouts[0] != 2 {
+		t.Errorf("Expected icmp_seq=2 to time out, got %v", timeouts)
+	}
+
+	// Both the target's own OnRecv and the pool's are called
+	if targetRecvs != 3 || poolRecvs != 5 {
+		t.Errorf("Expected 3 and 5 receives, got %v and %v", targetRecvs, poolRecvs)
+	}
+	if finished != 2 {
+		t.Errorf("Expected OnFinish for %v targets, got %v", 2, finished)
+	}
+}
+
+func TestPoolNoReply(t *testing.T) {
+	p := NewPool()
+	p.SetPrivileged(true)
+	p.Count = 2
+	AssertNoError(t, p.Add("127.0.0.1"))
+	p.conn = newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		if req.Body.(*icmp.Echo).Seq == 1 {
+			return nil
+		}
+		return []*icmp.Message{echoReply(req)}
+	})
+
+	// Without a Timeout the pool waits for the lost reply, but it's still
+	// counted as lost when the pool stops
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := p.RunContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	stats := p.Statistics("127.0.0.1")
+	if stats.PacketsRecv != 1 || stats.Losses[LossNoReply] != 1 {
+		t.Errorf("Expected 1 received and 1 lost, got %v and %v",
+			stats.PacketsRecv, stats.Losses)
+	}
+}
+
+func TestPoolSendError(t *testing.T) {
+	p := NewPool()
+	p.SetPrivileged(true)
+	p.Count = 2
+	AssertNoError(t, p.Add("127.0.0.1"))
+
+	// The first send fails, but not in a way which should stop the pool
+	conn := newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		return []*icmp.Message{echoReply(req)}
+	})
+	conn.writeErr = func(n int) syscall.Errno {
+		if n == 0 {
+			return syscall.EHOSTUNREACH
+		}
+		return 0
+	}
+	p.conn = conn
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	start := time.Now()
+	AssertNoError(t, p.RunContext(ctx))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the pool to finish once it had tried twice, took %v", elapsed)
+	}
+
+	stats := p.Statistics("127.0.0.1")
+	if stats.PacketsSent != 1 || stats.PacketsRecv != 1 {
+		t.Errorf("Expected 1 sent and received, got %v and %v",
+			stats.PacketsSent, stats.PacketsRecv)
+	}
+}
+
+func TestPoolFatalSendError(t *testing.T) {
+	p := NewPool()
+	p.SetPrivileged(true)
+	p.Count = 2
+	AssertNoError(t, p.Add("127.0.0.1"))
+	AssertNoError(t, p.Add("127.0.0.2"))
+
+	// Sending to 127.0.0.2 is never allowed, which only stops that target
+	conn := newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		return []*icmp.Message{echoReply(req)}
+	})
+	conn.writeErr = func(n int) syscall.Errno {
+		if n == 1 {
+			return syscall.EACCES
+		}
+		return 0
+	}
+	p.conn = conn
+
+	AssertNoError(t, p.Run())
+	if stats := p.Statistics("127.0.0.1"); stats.PacketsRecv != 2 {
+		t.Errorf("Expected %v, got %v", 2, stats.PacketsRecv)
+	}
+	if stats := p.Statistics("127.0.0.2"); stats.PacketsSent != 0 {
+		t.Errorf("Expected %v, got %v", 0, stats.PacketsSent)
+	}
+	if n := len(conn.Written()); n != 2 {
+		t.Errorf("Expected %v packets written, got %v", 2, n)
+	}
+
+	// Targets which share a socket can't have different socket settings
+	AssertNoError(t, p.Target("127.0.0.2").SetTTL(1))
+	if err := p.Run(); err == nil {
+		t.Errorf("Expected an error with differing TTLs")
+	}
+
+	// Once every target has failed, so has the pool
+	AssertNoError(t, p.Target("127.0.0.1").SetTTL(1))
+	conn.writeErr = func(int) syscall.Errno {
+		return syscall.EACCES
+	}
+	if err, ok := p.Run().(*net.OpError); !ok {
+		t.Errorf("Expected the send error, got %v", err)
+	}
+}
+
+func BenchmarkPool10k(b *testing.B) {
+	p := NewPool()
+	replies := make([]*packet, 10000)
+	for i := range replies {
+		ip := net.IPv4(10, 0, byte(i>>8), byte(i))
+		if err := p.Add(ip.String()); err != nil {
+			b.Fatal(err)
+		}
+		replies[i] = poolReply(b, ip)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.nextTarget()
+		p.processPacket(replies[i%len(replies)])
+	}
+}
+
+func poolReply(tb testing.TB, ip net.IP) *packet {
+	b, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeEchoReply,
+		Body: &icmp.Echo{Data: timeToBytes(time.Now())},
+	}).Marshal(nil)
+	if err != nil {
+		tb.Fatalf("Failed to marshal message: %s", err)
+	}
+	return &packet{bytes: b, nbytes: len(b), addr: &net.UDPAddr{IP: ip}}
+}
@@ -0,0 +1,90 @@
+// Package promping exports the statistics of one or more pingers as
+// Prometheus metrics.
+//
+//	pinger, err := ping.NewPinger("www.google.com")
+//	if err != nil {
+//		panic(err)
+//	}
+//	prometheus.MustRegister(promping.NewCollector(pinger))
+//	go pinger.Run()
+//
+// It's a separate package so the ping package doesn't depend on Prometheus.
+package promping
+
+import (
+	"sync"
+
+	"github.com/belak/go-ping"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	rttDesc = prometheus.NewDesc("ping_rtt_seconds",
+		"Round-trip time of echo replies.", []string{"target"}, nil)
+	sentDesc = prometheus.NewDesc("ping_packets_sent_total",
+		"Number of echo requests sent.", []string{"target"}, nil)
+	recvDesc = prometheus.NewDesc("ping_packets_received_total",
+		"Number of echo replies received, not counting duplicates.", []string{"target"}, nil)
+	lossDesc = prometheus.NewDesc("ping_packet_loss_ratio",
+		"Fraction of echo requests which were lost, from 0 to 1.", []string{"target"}, nil)
+)
+
+// Collector is a prometheus.Collector which reports the statistics of a set of
+// pingers, labelled by the address each one was given as its target. The
+// pingers can be running while they're collected.
+type Collector struct {
+	mu      sync.Mutex
+	pingers []*ping.Pinger
+}
+
+// NewCollector returns a Collector for the given pingers.
+func NewCollector(pingers ...*ping.Pinger) *Collector {
+	return &Collector{pingers: pingers}
+}
+
+// Add adds a pinger to those the Collector reports on.
+func (c *Collector) Add(p *ping.Pinger) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pingers = append(c.pingers, p)
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rttDesc
+	ch <- sentDesc
+	ch <- recvDesc
+	ch <- lossDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	pingers := append([]*ping.Pinger(nil), c.pingers...)
+	c.mu.Unlock()
+
+	for _, p := range pingers {
+		// Statistics takes a consistent snapshot, so this is safe while the
+		// pinger is running. The summary doesn't need Rtts, so it isn't
+		// copied out.
+		s := p.StatisticsWithRtts(1)
+
+		// Rtts may only be the most recent round-trip times, so the count
+		// and sum come from the whole run's totals, which never go down.
+		quantiles := map[float64]float64{
+			0.5:  s.P50Rtt.Seconds(),
+			0.9:  s.P90Rtt.Seconds(),
+			0.95: s.P95Rtt.Seconds(),
+			0.99: s.P99Rtt.Seconds(),
+		}
+
+		ch <- prometheus.MustNewConstSummary(rttDesc, uint64(s.PacketsRecv),
+			s.TotalRtt.Seconds(), quantiles, s.Addr)
+		ch <- prometheus.MustNewConstMetric(sentDesc, prometheus.CounterValue,
+			float64(s.PacketsSent), s.Addr)
+		ch <- prometheus.MustNewConstMetric(recvDesc, prometheus.CounterValue,
+			float64(s.PacketsRecv), s.Addr)
+		ch <- prometheus.MustNewConstMetric(lossDesc, prometheus.GaugeValue,
+			s.PacketLoss/100, s.Addr)
+	}
+}
@@ -0,0 +1,169 @@
+package promping
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/belak/go-ping"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCollector(t *testing.T) {
+	p1, err := ping.NewPinger("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p1.PacketsSent = 4
+	p1.PacketsRecv = 3
+
+	p2, err := ping.NewPinger("::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCollector(p1)
+	c.Add(p2)
+
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatal(err)
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]bool{
+		"ping_rtt_seconds":            true,
+		"ping_packets_sent_total":     true,
+		"ping_packets_received_total": true,
+		"ping_packet_loss_ratio":      true,
+	}
+	if len(families) != len(expected) {
+		t.Errorf("Expected %v metrics, got %v", len(expected), len(families))
+	}
+	for _, mf := range families {
+		name := mf.GetName()
+		if !expected[name] {
+			t.Errorf("Unexpected metric %s", name)
+			continue
+		}
+		if len(mf.GetMetric()) != 2 {
+			t.Errorf("%s: expected %v targets, got %v", name, 2, len(mf.GetMetric()))
+		}
+
+		for _, m := range mf.GetMetric() {
+			if len(m.GetLabel()) != 1 || m.GetLabel()[0].GetName() != "target" {
+				t.Errorf("%s: expected a target label, got %v", name, m.GetLabel())
+				continue
+			}
+			if m.GetLabel()[0].GetValue() != "127.0.0.1" {
+				continue
+			}
+
+			var got, want float64
+			switch name {
+			case "ping_packets_sent_total":
+				got, want = m.GetCounter().GetValue(), 4
+			case "ping_packets_received_total":
+				got, want = m.GetCounter().GetValue(), 3
+			case "ping_packet_loss_ratio":
+				got, want = m.GetGauge().GetValue(), 0.25
+			default:
+				continue
+			}
+			if got != want {
+				t.Errorf("%s: expected %v, got %v", name, want, got)
+			}
+		}
+	}
+}
+
+func TestCollectorStatsBufferLimit(t *testing.T) {
+	p, err := ping.NewPinger("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetPrivileged(true)
+	p.SetConn(newEchoConn())
+	p.Count = 5
+	p.Interval = 5 * time.Millisecond
+	if err := p.SetStatsBufferLimit(2); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := p.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(NewCollector(p)); err != nil {
+		t.Fatal(err)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The summary covers every reply, not just the ones still in Rtts
+	for _, mf := range families {
+		if mf.GetName() != "ping_rtt_seconds" {
+			continue
+		}
+		summary := mf.GetMetric()[0].GetSummary()
+		if summary.GetSampleCount() != 5 {
+			t.Errorf("Expected a count of %v, got %v", 5, summary.GetSampleCount())
+		}
+		if sum := summary.GetSampleSum(); sum != stats.TotalRtt.Seconds() || sum <= 0 {
+			t.Errorf("Expected a sum of %v, got %v", stats.TotalRtt.Seconds(), sum)
+		}
+		return
+	}
+	t.Errorf("Expected a ping_rtt_seconds summary")
+}
+
+// echoConn is a ping.Conn which answers every echo request written to it, as
+// if it were a privileged socket.
+type echoConn struct {
+	in     chan []byte
+	closed chan struct{}
+}
+
+func newEchoConn() *echoConn {
+	return &echoConn{in: make(chan []byte, 10), closed: make(chan struct{})}
+}
+
+func (c *echoConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case reply := <-c.in:
+		return copy(b, reply), &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}, nil
+	case <-c.closed:
+		return 0, nil, errors.New("read on a stopped echoConn")
+	}
+}
+
+func (c *echoConn) WriteTo(b []byte, dst net.Addr) (int, error) {
+	// An echo reply is the request with its type changed. The checksum
+	// isn't checked.
+	reply := append([]byte(nil), b...)
+	reply[0] = 0
+	c.in <- reply
+	return len(b), nil
+}
+
+func (c *echoConn) SetReadDeadline(t time.Time) error {
+	if !t.IsZero() {
+		select {
+		case <-c.closed:
+		default:
+			close(c.closed)
+		}
+	}
+	return nil
+}
+
+func (c *echoConn) Close() error { return nil }
@@ -0,0 +1,262 @@
+package ping
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	ringMagic      = "GPRF"
+	ringVersion    = 1
+	ringHeaderLen  = 16
+	ringRecordLen  = 52
+	ringRecordBody = ringRecordLen - 4
+)
+
+// Record is a single per-packet result stored in a RingFile.
+type Record struct {
+	// Time is when the record was written.
+	Time time.Time
+
+	// IPAddr is the address of the host which was pinged.
+	IPAddr *net.IPAddr
+
+	// Rtt is the round-trip time of the packet.
+	Rtt time.Duration
+
+	// Nbytes is the number of bytes in the message.
+	Nbytes int
+
+	// Seq is the ICMP sequence number.
+	Seq int
+}
+
+// RingFile is a fixed-size file of per-packet results. Once it holds its
+// maximum number of records, each new record overwrites the oldest one, so the
+// file always contains the most recent results and never grows.
+//
+// Every record is written in place with its own checksum and is never
+// rewritten, so if the process crashes, at most the record being written is
+// lost. Records can be recovered with ReadRingFile.
+//
+// To record every received packet, write to it from OnRecv:
+//
+//	ring, err := ping.OpenRingFile("ping.ring", 3600)
+//	if err != nil {
+//		panic(err)
+//	}
+//	defer ring.Close()
+//
+//	pinger.OnRecv = func(pkt *ping.Packet) {
+//		ring.Write(pkt)
+//	}
+type RingFile struct {
+	mu   sync.Mutex
+	f    *os.File
+	size int
+
+	// next is the index of the next record to write. Indexes start at 1 so
+	// that an all-zero slot can be recognized as unused.
+	next uint64
+}
+
+// OpenRingFile opens the ring file at path, creating it if it doesn't exist,
+// with room for the given number of records. If the file already exists it
+// must have been created with the same number of records, and new records
+// will be written after the ones it already contains.
+func OpenRingFile(path string, records int) (*RingFile, error) {
+	if records <= 0 {
+		return nil, fmt.Errorf("Invalid ring file size: %d", records)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &RingFile{f: f, size: records, next: 1}
+
+	header := make([]byte, ringHeaderLen)
+	_, err = io.ReadFull(f, header)
+	switch err {
+	case io.EOF:
+		err = r.writeHeader()
+	case nil:
+		var size int
+		if size, err = parseRingHeader(header); err == nil && size != records {
+			err = fmt.Errorf("Ring file %s holds %d records, not %d", path, size, records)
+		}
+		if err == nil {
+			err = r.seek()
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Write appends the given packet to the ring file, overwriting the oldest
+// record if the file is full.
+func (r *RingFile) Write(pkt *Packet) error {
+	b := make([]byte, ringRecordLen)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	binary.BigEndian.PutUint64(b[0:], r.next)
+	binary.BigEndian.PutUint64(b[8:], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint64(b[16:], uint64(pkt.Rtt))
+	binary.BigEndian.PutUint32(b[24:], uint32(pkt.Nbytes))
+	binary.BigEndian.PutUint32(b[28:], uint32(pkt.Seq))
+	if pkt.IPAddr != nil {
+		copy(b[32:48], pkt.IPAddr.IP.To16())
+	}
+	binary.BigEndian.PutUint32(b[ringRecordBody:], crc32.ChecksumIEEE(b[:ringRecordBody]))
+
+	if _, err := r.f.WriteAt(b, r.offset(r.next)); err != nil {
+		return err
+	}
+
+	r.next++
+	return nil
+}
+
+// Sync commits the ring file to stable storage. Written records already
+// survive a crash of the process, but not necessarily of the machine, until
+// Sync is called.
+func (r *RingFile) Sync() error {
+	return r.f.Sync()
+}
+
+// Close closes the ring file.
+func (r *RingFile) Close() error {
+	return r.f.Close()
+}
+
+// ReadRingFile loads every intact record from the ring file at path, oldest
+// first. Records which were only partially written are skipped.
+func ReadRingFile(path string) ([]*Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header := make([]byte, ringHeaderLen)
+	if _, err = io.ReadFull(f, header); err != nil {
+		return nil, err
+	}
+	size, err := parseRingHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	type indexed struct {
+		index  uint64
+		record *Record
+	}
+
+	var records []indexed
+	b := make([]byte, ringRecordLen)
+	for i := 0; i < size; i++ {
+		if _, err = io.ReadFull(f, b); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, err
+		}
+
+		index, rec := parseRingRecord(b)
+		if rec != nil {
+			records = append(records, indexed{index, rec})
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].index < records[j].index
+	})
+
+	out := make([]*Record, len(records))
+	for i := range records {
+		out[i] = records[i].record
+	}
+	return out, nil
+}
+
+func (r *RingFile) writeHeader() error {
+	header := make([]byte, ringHeaderLen)
+	copy(header, ringMagic)
+	binary.BigEndian.PutUint32(header[4:], ringVersion)
+	binary.BigEndian.PutUint32(header[8:], uint32(r.size))
+	_, err := r.f.WriteAt(header, 0)
+	return err
+}
+
+// seek finds the newest record in an existing ring file so writing can resume
+// after it.
+func (r *RingFile) seek() error {
+	b := make([]byte, ringRecordLen)
+	for i := 0; i < r.size; i++ {
+		_, err := r.f.ReadAt(b, ringHeaderLen+int64(i)*ringRecordLen)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		index, rec := parseRingRecord(b)
+		if rec != nil && index >= r.next {
+			r.next = index + 1
+		}
+	}
+	return nil
+}
+
+func (r *RingFile) offset(index uint64) int64 {
+	return ringHeaderLen + int64((index-1)%uint64(r.size))*ringRecordLen
+}
+
+func parseRingHeader(b []byte) (int, error) {
+	if string(b[:4]) != ringMagic {
+		return 0, errors.New("Not a ring file")
+	}
+	if v := binary.BigEndian.Uint32(b[4:]); v != ringVersion {
+		return 0, fmt.Errorf("Unsupported ring file version: %d", v)
+	}
+	return int(binary.BigEndian.Uint32(b[8:])), nil
+}
+
+func parseRingRecord(b []byte) (uint64, *Record) {
+	index := binary.BigEndian.Uint64(b[0:])
+	if index == 0 {
+		// Unused slot
+		return 0, nil
+	}
+	if crc32.ChecksumIEEE(b[:ringRecordBody]) != binary.BigEndian.Uint32(b[ringRecordBody:]) {
+		// Torn or corrupted write
+		return 0, nil
+	}
+
+	nsec := int64(binary.BigEndian.Uint64(b[8:]))
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, b[32:48])
+
+	return index, &Record{
+		Time:   time.Unix(nsec/1000000000, nsec%1000000000),
+		Rtt:    time.Duration(binary.BigEndian.Uint64(b[16:])),
+		Nbytes: int(binary.BigEndian.Uint32(b[24:])),
+		Seq:    int(binary.BigEndian.Uint32(b[28:])),
+		IPAddr: &net.IPAddr{IP: ip},
+	}
+}
@@ -0,0 +1,94 @@
+package ping
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-ping")
+	AssertNoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ping.ring")
+
+	ring, err := OpenRingFile(path, 3)
+	AssertNoError(t, err)
+
+	addr := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	for seq := 0; seq < 5; seq++ {
+		err = ring.Write(&Packet{
+			Rtt:    time.Duration(seq+1) * time.Millisecond,
+			IPAddr: addr,
+			Nbytes: 16,
+			Seq:    seq,
+		})
+		AssertNoError(t, err)
+	}
+	AssertNoError(t, ring.Close())
+
+	// Only the last 3 records should be kept, oldest first
+	records, err := ReadRingFile(path)
+	AssertNoError(t, err)
+	AssertRingSeqs(t, records, 2, 3, 4)
+	AssertEqualStrings(t, "127.0.0.1", records[0].IPAddr.String())
+	if records[0].Rtt != 3*time.Millisecond {
+		t.Errorf("Expected %v, got %v", 3*time.Millisecond, records[0].Rtt)
+	}
+	if records[0].Nbytes != 16 {
+		t.Errorf("Expected %v, got %v", 16, records[0].Nbytes)
+	}
+
+	// Reopening should continue after the newest record
+	ring, err = OpenRingFile(path, 3)
+	AssertNoError(t, err)
+	AssertNoError(t, ring.Write(&Packet{IPAddr: addr, Seq: 5}))
+	AssertNoError(t, ring.Close())
+
+	records, err = ReadRingFile(path)
+	AssertNoError(t, err)
+	AssertRingSeqs(t, records, 3, 4, 5)
+
+	// Reopening with a different size should fail
+	_, err = OpenRingFile(path, 4)
+	AssertError(t, err, "mismatched size")
+}
+
+func TestRingFileTornWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-ping")
+	AssertNoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ping.ring")
+
+	ring, err := OpenRingFile(path, 4)
+	AssertNoError(t, err)
+	for seq := 0; seq < 3; seq++ {
+		AssertNoError(t, ring.Write(&Packet{Seq: seq}))
+	}
+	AssertNoError(t, ring.Close())
+
+	// Simulate a crash halfway through writing the second record
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	AssertNoError(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff}, ringHeaderLen+ringRecordLen+20)
+	AssertNoError(t, err)
+	AssertNoError(t, f.Close())
+
+	records, err := ReadRingFile(path)
+	AssertNoError(t, err)
+	AssertRingSeqs(t, records, 0, 2)
+}
+
+func AssertRingSeqs(t *testing.T, records []*Record, seqs ...int) {
+	if len(records) != len(seqs) {
+		t.Fatalf("Expected %v records, got %v", len(seqs), len(records))
+	}
+	for i, seq := range seqs {
+		if records[i].Seq != seq {
+			t.Errorf("Expected seq %v, got %v", seq, records[i].Seq)
+		}
+	}
+}
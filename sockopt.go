@@ -0,0 +1,43 @@
+package ping
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/net/icmp"
+)
+
+// rawConn returns the raw connection underlying conn, so socket options which
+// x/net doesn't expose can be set on it directly.
+func rawConn(conn *icmp.PacketConn) (syscall.RawConn, error) {
+	var c net.PacketConn
+	if p4 := conn.IPv4PacketConn(); p4 != nil {
+		c = p4.PacketConn
+	} else if p6 := conn.IPv6PacketConn(); p6 != nil {
+		c = p6.PacketConn
+	}
+
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("Socket options aren't supported on this connection")
+	}
+	return sc.SyscallConn()
+}
+
+// control runs fn with the file descriptor of conn's socket, returning the
+// first error from either.
+func control(conn *icmp.PacketConn, fn func(fd uintptr) error) error {
+	raw, err := rawConn(conn)
+	if err != nil {
+		return err
+	}
+
+	var fnErr error
+	if err = raw.Control(func(fd uintptr) {
+		fnErr = fn(fd)
+	}); err != nil {
+		return err
+	}
+	return fnErr
+}
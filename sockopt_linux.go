@@ -0,0 +1,67 @@
+package ping
+
+import (
+	"syscall"
+
+	"golang.org/x/net/icmp"
+)
+
+// bindToDeviceSupported is whether bindToDevice can restrict a socket to an
+// interface. Where it can't, the socket is bound to the interface's address
+// instead.
+const bindToDeviceSupported = true
+
+// bindToDevice restricts conn to sending and receiving on the named interface
+// with SO_BINDTODEVICE.
+func bindToDevice(conn *icmp.PacketConn, name string) error {
+	return control(conn, func(fd uintptr) error {
+		return syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, name)
+	})
+}
+
+// dontFragmentSupported is whether setDontFragment is supported.
+const dontFragmentSupported = true
+
+// setDontFragment sets the Don't Fragment bit on conn's IPv4 packets, or stops
+// the kernel fragmenting its IPv6 packets, by turning on path MTU discovery.
+func setDontFragment(conn *icmp.PacketConn) error {
+	return control(conn, func(fd uintptr) error {
+		if conn.IPv4PacketConn() != nil {
+			return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+		}
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO)
+	})
+}
+
+// markSupported is whether setMark is supported.
+const markSupported = true
+
+// setMark sets the fwmark of conn's packets with SO_MARK.
+func setMark(conn *icmp.PacketConn, mark uint32) error {
+	return control(conn, func(fd uintptr) error {
+		return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(mark))
+	})
+}
+
+// setBroadcast allows conn to send to broadcast addresses with SO_BROADCAST.
+func setBroadcast(conn *icmp.PacketConn) error {
+	return control(conn, func(fd uintptr) error {
+		return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+	})
+}
+
+// kernelEchoID is whether the kernel sets the ID of echo requests sent on
+// unprivileged sockets, and only passes them the replies which match it.
+const kernelEchoID = true
+
+// unprivilegedHint explains why opening an unprivileged socket failed with err,
+// or returns "" if there's nothing to add.
+func unprivilegedHint(err error) string {
+	switch errno, _ := errnoOf(err); errno {
+	case syscall.EACCES, syscall.EPERM:
+		return "unprivileged ping needs the net.ipv4.ping_group_range sysctl to include one of the process's groups, see SetPrivileged"
+	case syscall.EPROTONOSUPPORT, syscall.EAFNOSUPPORT:
+		return "this kernel doesn't support unprivileged ping, see SetPrivileged"
+	}
+	return ""
+}
@@ -0,0 +1,146 @@
+package ping
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/net/icmp"
+)
+
+func TestSetDoNotFragment(t *testing.T) {
+	SkipUnlessPrivileged(t)
+
+	for _, addr := range []string{"127.0.0.1", "::1"} {
+		p, err := NewPinger(addr)
+		AssertNoError(t, err)
+		p.SetPrivileged(true)
+		AssertNoError(t, p.SetDoNotFragment(true))
+		AssertTrue(t, p.DoNotFragment())
+
+		proto := ipv4Proto["ip"]
+		level, opt, expected := syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO
+		if !p.ipv4 {
+			proto = ipv6Proto["ip"]
+			level, opt, expected = syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO
+		}
+
+		conn, err := p.listen(proto, "")
+		AssertNoError(t, err)
+		AssertNoError(t, p.setSocketOptions(conn))
+
+		var got int
+		AssertNoError(t, control(conn, func(fd uintptr) error {
+			got, err = syscall.GetsockoptInt(int(fd), level, opt)
+			return err
+		}))
+		conn.Close()
+		if got != expected {
+			t.Errorf("%s: expected MTU discovery mode %v, got %v", addr, expected, got)
+		}
+
+		// Large packets should still get through on loopback
+		AssertNoError(t, p.SetPayloadSize(1400))
+		p.Count = 1
+		stats, err := p.Run()
+		AssertNoError(t, err)
+		if stats.PacketsRecv != 1 {
+			t.Errorf("Expected %v from %s, got %v", 1, addr, stats.PacketsRecv)
+		}
+	}
+}
+
+func TestSetMark(t *testing.T) {
+	SkipUnlessPrivileged(t)
+
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	AssertNoError(t, p.SetMark(0x2a))
+	if p.Mark() != 0x2a {
+		t.Errorf("Expected %v, got %v", 0x2a, p.Mark())
+	}
+
+	conn, err := p.listen(ipv4Proto["ip"], "")
+	AssertNoError(t, err)
+	AssertNoError(t, p.setSocketOptions(conn))
+
+	var got int
+	AssertNoError(t, control(conn, func(fd uintptr) error {
+		got, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK)
+		return err
+	}))
+	conn.Close()
+	if got != 0x2a {
+		t.Errorf("Expected mark %v, got %v", 0x2a, got)
+	}
+
+	p.Count = 1
+	stats, err := p.Run()
+	AssertNoError(t, err)
+	if stats.PacketsRecv != 1 {
+		t.Errorf("Expected %v, got %v", 1, stats.PacketsRecv)
+	}
+}
+
+func TestSetBroadcast(t *testing.T) {
+	SkipUnlessPrivileged(t)
+
+	p, err := NewPinger("255.255.255.255")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.group = true
+
+	conn, err := p.listen(ipv4Proto["ip"], "")
+	AssertNoError(t, err)
+	defer conn.Close()
+	AssertNoError(t, p.setSocketOptions(conn))
+
+	var got int
+	AssertNoError(t, control(conn, func(fd uintptr) error {
+		got, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST)
+		return err
+	}))
+	if got != 1 {
+		t.Errorf("Expected SO_BROADCAST %v, got %v", 1, got)
+	}
+}
+
+func TestUnprivilegedHint(t *testing.T) {
+	denied := &net.OpError{Op: "listen", Net: "udp4", Err: os.NewSyscallError("socket", syscall.EACCES)}
+	if hint := unprivilegedHint(denied); !strings.Contains(hint, "ping_group_range") {
+		t.Errorf("Expected a hint about ping_group_range, got %q", hint)
+	}
+	AssertEqualStrings(t, "", unprivilegedHint(errors.New("address already in use")))
+
+	unsupported := &net.OpError{Op: "listen", Net: "udp4", Err: os.NewSyscallError("socket", syscall.EAFNOSUPPORT)}
+	if hint := unprivilegedHint(unsupported); !strings.Contains(hint, "doesn't support") {
+		t.Errorf("Expected a hint about kernel support, got %q", hint)
+	}
+
+	// Where unprivileged sockets aren't allowed, listening should say why.
+	// Which hint that is depends on why the kernel refused.
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	conn, err := p.listen(ipv4Proto["udp"], "")
+	if err == nil {
+		conn.Close()
+		t.Skip("Unprivileged ICMP sockets are available")
+	}
+	_, raw := icmp.ListenPacket(ipv4Proto["udp"], "")
+	switch errno, _ := errnoOf(raw); errno {
+	case syscall.EACCES, syscall.EPERM:
+		if !strings.Contains(err.Error(), "ping_group_range") {
+			t.Errorf("Expected a hint about ping_group_range, got %s", err)
+		}
+	case syscall.EPROTONOSUPPORT, syscall.EAFNOSUPPORT:
+		if !strings.Contains(err.Error(), "doesn't support") {
+			t.Errorf("Expected a hint about kernel support, got %s", err)
+		}
+	default:
+		t.Skipf("No hint expected for %s", raw)
+	}
+}
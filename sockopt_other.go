@@ -0,0 +1,52 @@
+//go:build !linux
+// +build !linux
+
+package ping
+
+import (
+	"errors"
+	"runtime"
+
+	"golang.org/x/net/icmp"
+)
+
+// bindToDeviceSupported is whether bindToDevice can restrict a socket to an
+// interface. Where it can't, the socket is bound to the interface's address
+// instead.
+const bindToDeviceSupported = false
+
+func bindToDevice(conn *icmp.PacketConn, name string) error {
+	return errors.New("Binding to an interface isn't supported on this platform")
+}
+
+// dontFragmentSupported is whether setDontFragment is supported.
+const dontFragmentSupported = false
+
+func setDontFragment(conn *icmp.PacketConn) error {
+	return errors.New("Setting the Don't Fragment bit isn't supported on this platform")
+}
+
+// markSupported is whether setMark is supported.
+const markSupported = false
+
+func setMark(conn *icmp.PacketConn, mark uint32) error {
+	return errors.New("Setting a socket mark isn't supported on this platform")
+}
+
+func setBroadcast(conn *icmp.PacketConn) error {
+	return errors.New("Sending to a broadcast address isn't supported on this platform")
+}
+
+// kernelEchoID is whether the kernel sets the ID of echo requests sent on
+// unprivileged sockets, and only passes them the replies which match it.
+const kernelEchoID = false
+
+// unprivilegedHint explains why opening an unprivileged socket failed with err,
+// or returns "" if there's nothing to add.
+func unprivilegedHint(err error) string {
+	switch runtime.GOOS {
+	case "darwin", "ios":
+		return ""
+	}
+	return "unprivileged ping is only supported on Linux and darwin, see SetPrivileged"
+}
@@ -0,0 +1,120 @@
+package ping
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// streamBuffer is how many events RunStream's channel holds before it starts
+// dropping them.
+const streamBuffer = 64
+
+// EventType is the kind of an Event.
+type EventType int
+
+const (
+	// EventSend is an echo request being sent. Its Packet is the one passed
+	// to OnSend.
+	EventSend EventType = iota
+
+	// EventRecv is a reply being received. Its Packet is the one passed to
+	// OnRecv.
+	EventRecv
+
+	// EventDuplicate is a duplicate reply being received. Its Packet is the
+	// one passed to OnDuplicateRecv.
+	EventDuplicate
+
+	// EventTimeout is an echo request timing out. Its Seq is the sequence
+	// number passed to OnTimeout.
+	EventTimeout
+
+	// EventFinish is the end of the run, and always the last event. Its
+	// Statistics and Err are what RunContext returned, and Dropped is the
+	// number of events which were dropped.
+	EventFinish
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventSend:
+		return "send"
+	case EventRecv:
+		return "recv"
+	case EventDuplicate:
+		return "duplicate"
+	case EventTimeout:
+		return "timeout"
+	case EventFinish:
+		return "finish"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// Event is something which happened during a run started with RunStream. Which
+// of its other fields are set depends on its Type.
+type Event struct {
+	Type EventType
+
+	// Packet is the packet sent or received, for EventSend, EventRecv and
+	// EventDuplicate.
+	Packet *Packet
+
+	// Seq is the sequence number of the packet which timed out, for
+	// EventTimeout.
+	Seq int
+
+	// Statistics is the statistics of the finished run, for EventFinish. It's
+	// nil if the pinger couldn't start.
+	Statistics *Statistics
+
+	// Err is the error the run ended with, if any, for EventFinish.
+	Err error
+
+	// Dropped is the number of events dropped because the channel was full,
+	// for EventFinish.
+	Dropped int
+}
+
+// RunStream runs the pinger with the given context in the background, and
+// returns a channel of what happens during the run, which is closed once it's
+// done. Like RunContext, the run ends when Count packets have been answered or
+// the context is done. The callbacks are still called as usual, before each
+// event is sent. They aren't replaced while it runs.
+//
+// Sending an event never blocks the run. If the consumer falls more than 64
+// events behind, further events are dropped until it catches up, and counted
+// in the EventFinish event's Dropped. The EventFinish event itself is never
+// dropped, but the run's goroutine waits until it's received, so the channel
+// should always be drained until it's closed.
+func (p *Pinger) RunStream(ctx context.Context) <-chan Event {
+	events := make(chan Event, streamBuffer)
+
+	// Packets are sent from a goroutine of their own, so sends can race with
+	// the other events.
+	var mu sync.Mutex
+	dropped := 0
+	emit := func(e Event) {
+		select {
+		case events <- e:
+		default:
+			mu.Lock()
+			dropped++
+			mu.Unlock()
+		}
+	}
+
+	go func() {
+		defer close(events)
+
+		stats, err := p.runContext(ctx, 0, emit)
+
+		mu.Lock()
+		finish := Event{Type: EventFinish, Statistics: stats, Err: err, Dropped: dropped}
+		mu.Unlock()
+		events <- finish
+	}()
+	return events
+}
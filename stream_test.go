@@ -0,0 +1,133 @@
+package ping
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+func TestRunStream(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.SetConn(newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		return []*icmp.Message{echoReply(req)}
+	}))
+	p.Count = 3
+	p.Interval = 20 * time.Millisecond
+
+	recvs := 0
+	replaced := false
+	p.OnRecv = func(pkt *Packet) {
+		recvs++
+		replaced = replaced || p.OnSend != nil
+	}
+
+	var events []Event
+	for e := range p.RunStream(context.Background()) {
+		events = append(events, e)
+	}
+
+	// Each packet is sent and received before the next one is sent, though
+	// the reply can be seen before the send is
+	if len(events) != 7 {
+		t.Fatalf("Expected %v events, got %v", 7, events)
+	}
+	for seq := 0; seq < 3; seq++ {
+		var types []EventType
+		for _, e := range events[seq*2 : seq*2+2] {
+			if e.Packet == nil || e.Packet.Seq != seq {
+				t.Errorf("Expected a packet with icmp_seq=%d, got %+v", seq, e)
+				continue
+			}
+			types = append(types, e.Type)
+		}
+		if len(types) != 2 || types[0] == types[1] ||
+			(types[0] != EventSend && types[0] != EventRecv) ||
+			(types[1] != EventSend && types[1] != EventRecv) {
+			t.Errorf("Expected a send and a receive for icmp_seq=%d, got %v", seq, types)
+		}
+	}
+
+	finish := events[6]
+	if finish.Type != EventFinish {
+		t.Fatalf("Expected %v, got %v", EventFinish, finish.Type)
+	}
+	AssertNoError(t, finish.Err)
+	if finish.Statistics == nil || finish.Statistics.PacketsRecv != 3 {
+		t.Errorf("Expected 3 packets received, got %+v", finish.Statistics)
+	}
+	if finish.Dropped != 0 {
+		t.Errorf("Expected %v, got %v", 0, finish.Dropped)
+	}
+
+	// The pinger's own callbacks are still called, and never replaced
+	if recvs != 3 {
+		t.Errorf("Expected %v, got %v", 3, recvs)
+	}
+	if replaced || p.OnSend != nil {
+		t.Errorf("Expected OnSend to be left unset")
+	}
+}
+
+func TestRunStreamDropped(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.SetConn(newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		return []*icmp.Message{echoReply(req)}
+	}))
+	p.Count = 40
+	p.Interval = time.Millisecond
+
+	finished := make(chan struct{})
+	p.OnFinish = func(*Statistics) {
+		close(finished)
+	}
+
+	// Nothing is read until the run is over, so all but the first
+	// streamBuffer events should be dropped, apart from the last
+	events := p.RunStream(context.Background())
+	<-finished
+
+	n := 0
+	var finish Event
+	for e := range events {
+		if e.Type == EventFinish {
+			finish = e
+			continue
+		}
+		n++
+	}
+	if n != streamBuffer {
+		t.Errorf("Expected %v events, got %v", streamBuffer, n)
+	}
+	if finish.Type != EventFinish || finish.Dropped != 80-streamBuffer {
+		t.Errorf("Expected %v dropped, got %+v", 80-streamBuffer, finish)
+	}
+}
+
+func TestRunStreamError(t *testing.T) {
+	p, err := NewPinger("127.0.0.1")
+	AssertNoError(t, err)
+	p.SetPrivileged(true)
+	p.SetConn(newFakeConn(func(req *icmp.Message) []*icmp.Message {
+		return nil
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var events []Event
+	for e := range p.RunStream(ctx) {
+		events = append(events, e)
+	}
+	if len(events) == 0 || events[len(events)-1].Type != EventFinish {
+		t.Fatalf("Expected the last event to be %v, got %v", EventFinish, events)
+	}
+	if err := events[len(events)-1].Err; err != context.Canceled {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+	}
+}